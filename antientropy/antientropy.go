@@ -0,0 +1,269 @@
+// Package antientropy implements a pluggable background gossip/anti-entropy loop that
+// reconciles a vnode's owned key ranges against its replica peers, independent of the
+// foreground ProposeTx/CommitTx write path. The foreground fan-out can silently drop a
+// write on a lagging replica (its goroutine pushes an error to a bounded channel and
+// the rest of the cohort bails), so this loop periodically exchanges Merkle digests
+// with each replica peer and pulls whatever is missing or newer, in the spirit of the
+// background healing IPFS/bitswap does for content reconciliation.
+package antientropy
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/hexablock/blockring/structs"
+	"github.com/hexablock/txlog"
+)
+
+// LogTransport is the subset of the ring's log transport an anti-entropy Loop needs to
+// exchange digests with a replica peer and pull missing or newer transactions.
+type LogTransport interface {
+	// RangeDigest returns the Merkle digest for [rangeStart, rangeEnd) at depth. path is
+	// the chain of bucket-prefix bytes chosen by the caller's descent from the root
+	// digest down to this node (nil at the root), so the replica builds the digest for
+	// exactly the subtree being resolved rather than the whole range re-bucketed fresh.
+	RangeDigest(ctx context.Context, loc *structs.Location, rangeStart, rangeEnd []byte, depth int, path []byte) (*Digest, error)
+	GetTx(ctx context.Context, loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error)
+}
+
+// Digest is a node in the Merkle tree built over {key -> latest txlog.Meta.Hash} pairs
+// for a key range, bucketed by hash prefix. Above leaf Depth it holds child roots
+// keyed by prefix byte; at leaf Depth it holds the key/hash pairs themselves so a
+// divergent bucket can be resolved down to individual keys.
+type Digest struct {
+	RangeStart, RangeEnd []byte
+	Depth                int
+	Root                 []byte
+	Children             map[byte][]byte   // prefix -> child Digest.Root, above leaf depth
+	Entries              map[string][]byte // key -> latest hash, at leaf depth only
+}
+
+// RangeStore is implemented by whatever owns the local key range index (typically the
+// LogRing's backing store) so a Loop can build local digests and apply entries pulled
+// from a peer during reconciliation.
+type RangeStore interface {
+	// Digest builds the local Merkle digest for [rangeStart, rangeEnd) at depth.
+	Digest(rangeStart, rangeEnd []byte, depth int) (*Digest, error)
+	// Descend builds the child Digest for a single diverged bucket, one level deeper.
+	// path is the full chain of bucket-prefix bytes from the root down to and including
+	// the diverged bucket being descended into, so the bucket is identified unambiguously
+	// below the first level (a single trailing byte is not enough past depth 1).
+	Descend(rangeStart, rangeEnd []byte, depth int, path []byte) (*Digest, error)
+	// Apply writes a tx pulled from a peer into the local store.
+	Apply(key []byte, tx *txlog.Tx, meta *txlog.Meta) error
+}
+
+// Peer is a replica a Loop reconciles an owned range against.
+type Peer struct {
+	Location *structs.Location
+	Log      LogTransport
+}
+
+// Range is an owned key range reconciled against a fixed set of replica peers on every
+// tick of the Loop.
+type Range struct {
+	Start, End []byte
+	Peers      []*Peer
+}
+
+// Config tunes a Loop's reconciliation behavior.
+type Config struct {
+	// Interval is how often each registered range is reconciled.
+	Interval time.Duration
+	// MaxConcurrentRanges bounds how many ranges are reconciled at once.
+	MaxConcurrentRanges int
+	// BandwidthCap bounds how many txs are pulled per range per tick; 0 is unbounded.
+	BandwidthCap int
+	// Depth is the Merkle tree depth used when bucketing keys by hash prefix.
+	Depth int
+}
+
+// DefaultConfig returns reasonable defaults for a background reconciliation loop.
+func DefaultConfig() Config {
+	return Config{
+		Interval:            30 * time.Second,
+		MaxConcurrentRanges: 4,
+		BandwidthCap:        0,
+		Depth:               4,
+	}
+}
+
+// Loop runs background anti-entropy reconciliation for a set of owned ranges against
+// their replica peers, on a timer, until its context is cancelled.
+type Loop struct {
+	cfg   Config
+	store RangeStore
+
+	mu     sync.Mutex
+	ranges []Range
+	sem    chan struct{}
+}
+
+// NewLoop instantiates a Loop that reconciles ranges registered via AddRange against
+// store, using cfg to bound concurrency and bandwidth. A zero Interval falls back to
+// DefaultConfig.
+func NewLoop(cfg Config, store RangeStore) *Loop {
+	if cfg.Interval <= 0 {
+		cfg = DefaultConfig()
+	}
+	return &Loop{cfg: cfg, store: store, sem: make(chan struct{}, cfg.MaxConcurrentRanges)}
+}
+
+// AddRange registers an owned key range to reconcile against its peers on each tick.
+func (l *Loop) AddRange(r Range) {
+	l.mu.Lock()
+	l.ranges = append(l.ranges, r)
+	l.mu.Unlock()
+}
+
+// Run ticks every cfg.Interval, reconciling up to cfg.MaxConcurrentRanges ranges at
+// once, until ctx is cancelled.
+func (l *Loop) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.cfg.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.tick(ctx)
+		}
+	}
+}
+
+func (l *Loop) tick(ctx context.Context) {
+	l.mu.Lock()
+	ranges := make([]Range, len(l.ranges))
+	copy(ranges, l.ranges)
+	l.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, r := range ranges {
+		r := r
+		select {
+		case l.sem <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-l.sem }()
+			l.reconcile(ctx, r)
+		}()
+	}
+	wg.Wait()
+}
+
+// reconcile exchanges root digests with each of r's peers and, on mismatch, recursively
+// descends the Merkle tree to isolate the divergent buckets before pulling the
+// missing/newer txs directly.
+func (l *Loop) reconcile(ctx context.Context, r Range) {
+	local, err := l.store.Digest(r.Start, r.End, l.cfg.Depth)
+	if err != nil {
+		return
+	}
+
+	pulled := 0
+	for _, peer := range r.Peers {
+		if ctx.Err() != nil {
+			return
+		}
+
+		remote, err := peer.Log.RangeDigest(ctx, peer.Location, r.Start, r.End, l.cfg.Depth, nil)
+		if err != nil {
+			continue
+		}
+		if string(remote.Root) == string(local.Root) {
+			continue // replicas already agree on this range
+		}
+
+		pulled = l.resolve(ctx, peer, local, remote, nil, pulled)
+	}
+}
+
+// resolve recursively descends the Merkle tree from a divergent pair of digests, pulling
+// individual keys once it bottoms out at a leaf bucket. path is the chain of
+// bucket-prefix bytes chosen from the root down to local/remote, so that each descent
+// below the root asks for the exact diverged subtree instead of re-digesting the whole
+// range at a deeper level.
+func (l *Loop) resolve(ctx context.Context, peer *Peer, local, remote *Digest, path []byte, pulled int) int {
+	if local.Entries != nil || remote.Entries != nil {
+		return l.pullDiverged(ctx, peer, local.Entries, remote.Entries, pulled)
+	}
+
+	for prefix, remoteChild := range remote.Children {
+		if ctx.Err() != nil || (l.cfg.BandwidthCap > 0 && pulled >= l.cfg.BandwidthCap) {
+			return pulled
+		}
+
+		if localChild, ok := local.Children[prefix]; ok && string(localChild) == string(remoteChild) {
+			continue // this bucket already agrees
+		}
+
+		childPath := make([]byte, len(path)+1)
+		copy(childPath, path)
+		childPath[len(path)] = prefix
+
+		localNext, err := l.store.Descend(local.RangeStart, local.RangeEnd, local.Depth, childPath)
+		if err != nil {
+			continue
+		}
+		remoteNext, err := peer.Log.RangeDigest(ctx, peer.Location, local.RangeStart, local.RangeEnd, local.Depth+1, childPath)
+		if err != nil {
+			continue
+		}
+
+		pulled = l.resolve(ctx, peer, localNext, remoteNext, childPath, pulled)
+	}
+
+	return pulled
+}
+
+// pullDiverged fetches and applies every key present in remote but missing, or hashed
+// differently, from local.
+func (l *Loop) pullDiverged(ctx context.Context, peer *Peer, local, remote map[string][]byte, pulled int) int {
+	for key, remoteHash := range remote {
+		if ctx.Err() != nil || (l.cfg.BandwidthCap > 0 && pulled >= l.cfg.BandwidthCap) {
+			return pulled
+		}
+		if localHash, ok := local[key]; ok && string(localHash) == string(remoteHash) {
+			continue
+		}
+
+		tx, meta, err := peer.Log.GetTx(ctx, peer.Location, remoteHash, txlog.Options{})
+		if err != nil {
+			continue
+		}
+		if err := l.store.Apply([]byte(key), tx, meta); err == nil {
+			pulled++
+		}
+	}
+	return pulled
+}
+
+// BucketPrefix returns the single byte a RangeStore implementation should bucket hash
+// under at depth d when building a Digest's Children map.
+func BucketPrefix(hash []byte, d int) byte {
+	if d >= len(hash) {
+		return 0
+	}
+	return hash[d]
+}
+
+// HashChildren combines a node's child roots into its own root hash. RangeStore
+// implementations should use this to compute Digest.Root above leaf depth so that two
+// independently built digests for the same range agree.
+func HashChildren(children map[byte][]byte) []byte {
+	h := sha256.New()
+	for i := 0; i < 256; i++ {
+		if c, ok := children[byte(i)]; ok {
+			h.Write(c)
+		}
+	}
+	return h.Sum(nil)
+}
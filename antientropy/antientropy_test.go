@@ -0,0 +1,186 @@
+package antientropy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hexablock/blockring/structs"
+	"github.com/hexablock/txlog"
+)
+
+// capturedCall records the depth/path a fake RangeStore or LogTransport was asked to
+// build a digest for, so tests can assert the descent targets the exact diverged
+// subtree instead of re-digesting the whole range.
+type capturedCall struct {
+	depth int
+	path  []byte
+}
+
+// fakeStore is a RangeStore whose Descend response depends only on the path depth
+// reached so far: one mismatched bucket at depth 1, a leaf (Entries) at depth 2.
+type fakeStore struct {
+	descendCalls []capturedCall
+	applyCalls   []string
+}
+
+func (f *fakeStore) Digest(rangeStart, rangeEnd []byte, depth int) (*Digest, error) {
+	return nil, nil
+}
+
+func (f *fakeStore) Descend(rangeStart, rangeEnd []byte, depth int, path []byte) (*Digest, error) {
+	cp := append([]byte(nil), path...)
+	f.descendCalls = append(f.descendCalls, capturedCall{depth: depth, path: cp})
+
+	if len(cp) == 1 {
+		return &Digest{RangeStart: rangeStart, RangeEnd: rangeEnd, Depth: depth + 1, Children: map[byte][]byte{7: {1}}}, nil
+	}
+	return &Digest{RangeStart: rangeStart, RangeEnd: rangeEnd, Depth: depth + 1, Entries: map[string][]byte{}}, nil
+}
+
+func (f *fakeStore) Apply(key []byte, tx *txlog.Tx, meta *txlog.Meta) error {
+	f.applyCalls = append(f.applyCalls, string(key))
+	return nil
+}
+
+// fakeLogTransport is a LogTransport whose RangeDigest response mirrors fakeStore's
+// Descend, one level deeper, bottoming out at a single diverged key.
+type fakeLogTransport struct {
+	rangeDigestCalls []capturedCall
+	getTxCalls       int
+}
+
+func (f *fakeLogTransport) RangeDigest(ctx context.Context, loc *structs.Location, rangeStart, rangeEnd []byte, depth int, path []byte) (*Digest, error) {
+	cp := append([]byte(nil), path...)
+	f.rangeDigestCalls = append(f.rangeDigestCalls, capturedCall{depth: depth, path: cp})
+
+	if len(cp) == 1 {
+		return &Digest{Children: map[byte][]byte{7: {2}}}, nil
+	}
+	return &Digest{Entries: map[string][]byte{"abc": {9}}}, nil
+}
+
+func (f *fakeLogTransport) GetTx(ctx context.Context, loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	f.getTxCalls++
+	return &txlog.Tx{}, &txlog.Meta{}, nil
+}
+
+func TestResolveThreadsPathToDivergedSubtree(t *testing.T) {
+	store := &fakeStore{}
+	trans := &fakeLogTransport{}
+	loop := NewLoop(DefaultConfig(), store)
+	peer := &Peer{Location: &structs.Location{}, Log: trans}
+
+	local := &Digest{Depth: 0, Children: map[byte][]byte{5: {1}}}
+	remote := &Digest{Depth: 0, Children: map[byte][]byte{5: {2}}}
+
+	pulled := loop.resolve(context.Background(), peer, local, remote, nil, 0)
+
+	if pulled != 1 {
+		t.Fatalf("expected 1 key pulled, got %d", pulled)
+	}
+
+	wantDescend := []capturedCall{
+		{depth: 0, path: []byte{5}},
+		{depth: 1, path: []byte{5, 7}},
+	}
+	if !reflect.DeepEqual(store.descendCalls, wantDescend) {
+		t.Fatalf("Descend calls = %+v, want %+v", store.descendCalls, wantDescend)
+	}
+
+	wantRangeDigest := []capturedCall{
+		{depth: 1, path: []byte{5}},
+		{depth: 2, path: []byte{5, 7}},
+	}
+	if !reflect.DeepEqual(trans.rangeDigestCalls, wantRangeDigest) {
+		t.Fatalf("RangeDigest calls = %+v, want %+v", trans.rangeDigestCalls, wantRangeDigest)
+	}
+
+	if len(store.applyCalls) != 1 || store.applyCalls[0] != "abc" {
+		t.Fatalf("Apply calls = %v, want [abc]", store.applyCalls)
+	}
+	if trans.getTxCalls != 1 {
+		t.Fatalf("GetTx calls = %d, want 1", trans.getTxCalls)
+	}
+}
+
+func TestResolveSkipsAgreeingBuckets(t *testing.T) {
+	store := &fakeStore{}
+	trans := &fakeLogTransport{}
+	loop := NewLoop(DefaultConfig(), store)
+	peer := &Peer{Location: &structs.Location{}, Log: trans}
+
+	local := &Digest{Depth: 0, Children: map[byte][]byte{5: {1}}}
+	remote := &Digest{Depth: 0, Children: map[byte][]byte{5: {1}}} // already agrees
+
+	pulled := loop.resolve(context.Background(), peer, local, remote, nil, 0)
+
+	if pulled != 0 {
+		t.Fatalf("expected no keys pulled for an agreeing bucket, got %d", pulled)
+	}
+	if len(store.descendCalls) != 0 || len(trans.rangeDigestCalls) != 0 {
+		t.Fatalf("expected no descent for an agreeing bucket, got Descend=%v RangeDigest=%v", store.descendCalls, trans.rangeDigestCalls)
+	}
+}
+
+func TestPullDivergedRespectsBandwidthCap(t *testing.T) {
+	store := &fakeStore{}
+	trans := &fakeLogTransport{}
+	cfg := DefaultConfig()
+	cfg.BandwidthCap = 1
+	loop := NewLoop(cfg, store)
+	peer := &Peer{Location: &structs.Location{}, Log: trans}
+
+	remote := map[string][]byte{"a": {1}, "b": {2}}
+	pulled := loop.pullDiverged(context.Background(), peer, nil, remote, 0)
+
+	if pulled != 1 {
+		t.Fatalf("expected BandwidthCap to stop pulling after 1 key, got %d", pulled)
+	}
+}
+
+func TestPullDivergedSkipsMatchingHashes(t *testing.T) {
+	store := &fakeStore{}
+	trans := &fakeLogTransport{}
+	loop := NewLoop(DefaultConfig(), store)
+	peer := &Peer{Location: &structs.Location{}, Log: trans}
+
+	local := map[string][]byte{"a": {1}}
+	remote := map[string][]byte{"a": {1}, "b": {2}}
+
+	pulled := loop.pullDiverged(context.Background(), peer, local, remote, 0)
+
+	if pulled != 1 {
+		t.Fatalf("expected only the diverged key to be pulled, got %d", pulled)
+	}
+	if len(store.applyCalls) != 1 || store.applyCalls[0] != "b" {
+		t.Fatalf("Apply calls = %v, want [b]", store.applyCalls)
+	}
+}
+
+func TestBucketPrefix(t *testing.T) {
+	hash := []byte{0xaa, 0xbb, 0xcc}
+
+	if got := BucketPrefix(hash, 1); got != 0xbb {
+		t.Fatalf("BucketPrefix(hash, 1) = %x, want bb", got)
+	}
+	if got := BucketPrefix(hash, 10); got != 0 {
+		t.Fatalf("BucketPrefix(hash, 10) = %x, want 0 for an out-of-range depth", got)
+	}
+}
+
+func TestHashChildrenOrderIndependent(t *testing.T) {
+	children := map[byte][]byte{1: {1}, 2: {2}, 3: {3}}
+
+	a := HashChildren(children)
+	b := HashChildren(map[byte][]byte{3: {3}, 1: {1}, 2: {2}})
+
+	if !reflect.DeepEqual(a, b) {
+		t.Fatalf("HashChildren should be independent of map iteration order: %x != %x", a, b)
+	}
+
+	other := HashChildren(map[byte][]byte{1: {1}, 2: {2}})
+	if reflect.DeepEqual(a, other) {
+		t.Fatalf("HashChildren should differ when the child set differs")
+	}
+}
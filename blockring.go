@@ -1,29 +1,42 @@
 package blockring
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"sync"
-	"sync/atomic"
+	"time"
 
 	"github.com/hexablock/blockring/rpc"
 	"github.com/hexablock/blockring/structs"
+	blksync "github.com/hexablock/blockring/sync"
 	"github.com/hexablock/blockring/utils"
 )
 
-// LogTransport implements a transport for the distributed log
+// LogTransport implements a transport for the distributed log. Every method takes a
+// context as its first parameter so a caller can cancel a slow fan-out, enforce a
+// per-request deadline, or propagate a tracing ID down to the wire.
 type LogTransport interface {
-	ProposeEntry(loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error)
-	NewEntry(loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogEntryBlock, *structs.Location, error)
-	CommitEntry(loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error)
-	GetLogBlock(loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogBlock, *structs.Location, error)
+	ProposeEntry(ctx context.Context, loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error)
+	NewEntry(ctx context.Context, loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogEntryBlock, *structs.Location, error)
+	CommitEntry(ctx context.Context, loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error)
+	GetLogBlock(ctx context.Context, loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogBlock, *structs.Location, error)
+	// GetHeaderSkeleton returns a sparse skeleton of LogEntryBlock headers across
+	// keyRange, one every step entries, for use by the fast-sync subsystem.
+	GetHeaderSkeleton(ctx context.Context, loc *structs.Location, keyRange structs.KeyRange, step int) ([]*structs.LogEntryBlock, error)
+	// GetHeaderRange returns the headers for every key strictly between start and end
+	// (end may be nil to mean through the end of the owning range), for use by the
+	// fast-sync subsystem to fill in the keys a GetHeaderSkeleton call skipped over.
+	GetHeaderRange(ctx context.Context, loc *structs.Location, start, end []byte) ([]*structs.LogEntryBlock, error)
 }
 
-// BlockTransport implements the transport interface for the block store.
+// BlockTransport implements the transport interface for the block store. Every method
+// takes a context as its first parameter, mirroring LogTransport.
 type BlockTransport interface {
-	GetBlock(loc *structs.Location, id []byte) (*structs.Block, error)
-	SetBlock(loc *structs.Location, block *structs.Block) error
-	TransferBlock(loc *structs.Location, id []byte) error
-	ReleaseBlock(loc *structs.Location, id []byte) error
+	GetBlock(ctx context.Context, loc *structs.Location, id []byte) (*structs.Block, error)
+	SetBlock(ctx context.Context, loc *structs.Location, block *structs.Block) error
+	TransferBlock(ctx context.Context, loc *structs.Location, id []byte) error
+	ReleaseBlock(ctx context.Context, loc *structs.Location, id []byte) error
 }
 
 // BlockRing is the core interface to perform operations around the ring.
@@ -65,7 +78,7 @@ func (br *BlockRing) EnableProximityShifting(enable bool) {
 }
 
 // SetBlock writes the block to the ring with the specified replicas
-func (br *BlockRing) SetBlock(block *structs.Block, opts ...structs.RequestOptions) (*structs.Location, error) {
+func (br *BlockRing) SetBlock(ctx context.Context, block *structs.Block, opts ...structs.RequestOptions) (*structs.Location, error) {
 
 	o := structs.DefaultRequestOptions()
 	if len(opts) > 0 {
@@ -80,33 +93,40 @@ func (br *BlockRing) SetBlock(block *structs.Block, opts ...structs.RequestOptio
 	}
 
 	loc := &structs.Location{Id: id, Vnode: vns[0], Priority: 0}
-	err = br.blkTrans.SetBlock(loc, block)
+	err = br.blkTrans.SetBlock(ctx, loc, block)
 	return loc, err
 }
 
-// GetBlock lookups up the id hash then uses upto max successors to find the block.
-func (br *BlockRing) GetBlock(id []byte, opts ...structs.RequestOptions) (*structs.Location, *structs.Block, error) {
+// GetBlock lookups up the id hash then uses upto max successors to find the block. With
+// the default ReadOne consistency it routes the hash until the first replica responds.
+// At ReadQuorum/ReadAll it queries multiple replicas in parallel and returns the first
+// successful response among them. Unlike GetLogBlock/GetTx, this is correct to race on
+// the first response rather than comparing for recency: id is the block's content hash
+// (id := block.ID()), so every replica that answers for the same id must return
+// bit-identical, immutable content — there is no "staler" or "fresher" Block to pick
+// between, only "has it" or "doesn't have it yet".
+func (br *BlockRing) GetBlock(ctx context.Context, id []byte, opts ...structs.RequestOptions) (*structs.Location, *structs.Block, error) {
 	o := structs.DefaultRequestOptions()
 	if len(opts) > 0 {
 		o = &opts[0]
 	}
 
-	var (
-		blk *structs.Block
-		loc *structs.Location
-	)
-
-	err := br.locator.RouteHash(id, int(o.PeerSetSize), func(l *structs.Location) bool {
-		if b, err := br.blkTrans.GetBlock(l, id); err == nil {
-			blk = b
-			loc = l
-			return false
-		}
-		return true
-	})
+	if o.ReadConsistency == ReadOne {
+		var (
+			blk *structs.Block
+			loc *structs.Location
+		)
+
+		err := br.locator.RouteHash(ctx, id, int(o.PeerSetSize), func(l *structs.Location) bool {
+			if b, err := br.blkTrans.GetBlock(ctx, l, id); err == nil {
+				blk = b
+				loc = l
+				return false
+			}
+			return true
+		})
 
-	if err == nil {
-		if blk == nil {
+		if err == nil && blk == nil {
 			err = errors.New("not found")
 		}
 
@@ -120,14 +140,53 @@ func (br *BlockRing) GetBlock(id []byte, opts ...structs.RequestOptions) (*struc
 				},
 			}
 		}*/
+
+		return loc, blk, err
+	}
+
+	_, vns, err := br.locator.LookupHash(id, int(o.PeerSetSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := len(vns)
+	if o.ReadConsistency == ReadQuorum {
+		n = n/2 + 1
+	}
+
+	type result struct {
+		blk *structs.Block
+		loc *structs.Location
+	}
+	resCh := make(chan result, n)
+	for i, vn := range vns[:n] {
+		go func(loc *structs.Location) {
+			b, err := br.blkTrans.GetBlock(ctx, loc, id)
+			if err != nil {
+				resCh <- result{}
+				return
+			}
+			resCh <- result{blk: b, loc: loc}
+		}(&structs.Location{Id: id, Vnode: vn, Priority: int32(i)})
+	}
+
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-resCh:
+			if r.blk != nil {
+				return r.loc, r.blk, nil
+			}
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
 	}
 
-	return loc, blk, err
+	return nil, nil, errors.New("not found")
 }
 
 // GetRootBlock gets a root block with the given id
-func (br *BlockRing) GetRootBlock(id []byte, opts ...structs.RequestOptions) (*structs.Location, *structs.RootBlock, error) {
-	loc, block, err := br.GetBlock(id, opts...)
+func (br *BlockRing) GetRootBlock(ctx context.Context, id []byte, opts ...structs.RequestOptions) (*structs.Location, *structs.RootBlock, error) {
+	loc, block, err := br.GetBlock(ctx, id, opts...)
 	if err == nil {
 		var rb structs.RootBlock
 		err = rb.DecodeBlock(block)
@@ -136,41 +195,96 @@ func (br *BlockRing) GetRootBlock(id []byte, opts ...structs.RequestOptions) (*s
 	return loc, nil, err
 }
 
-// GetLogBlock gets the LogBlock by routing the key until it is found.
-func (br *BlockRing) GetLogBlock(key []byte, opts ...structs.RequestOptions) (*structs.Location, *structs.LogBlock, error) {
+// GetLogBlock gets the LogBlock for a key. With the default ReadOne consistency it
+// routes the key until the first replica responds. At ReadQuorum/ReadAll it queries
+// multiple replicas in parallel, waits for all of them, and returns the one with the
+// most entries, i.e. the longest chain for key: unlike GetBlock, key is mutable and a
+// LogBlock is a chain of entries that grows as new ones are proposed, so a replica that
+// answers first may simply be a lagging one that hasn't seen the latest append yet. This
+// mirrors how GetTx picks the response with the greatest txlog.Meta height.
+func (br *BlockRing) GetLogBlock(ctx context.Context, key []byte, opts ...structs.RequestOptions) (*structs.Location, *structs.LogBlock, error) {
 
 	o := *structs.DefaultRequestOptions()
 	if len(opts) > 0 {
 		o = opts[0]
 	}
 
-	var (
-		blk *structs.LogBlock
-		loc *structs.Location
-	)
-
-	err := br.locator.RouteKey(key, int(o.PeerSetSize), func(l *structs.Location) bool {
-		if b, _, err := br.logTrans.GetLogBlock(l, key, o); err == nil {
-			blk = b
-			loc = l
-			return false
-		}
-		return true
-	})
+	if o.ReadConsistency == ReadOne {
+		var (
+			blk *structs.LogBlock
+			loc *structs.Location
+		)
+
+		err := br.locator.RouteKey(ctx, key, int(o.PeerSetSize), func(l *structs.Location) bool {
+			if b, _, err := br.logTrans.GetLogBlock(ctx, l, key, o); err == nil {
+				blk = b
+				loc = l
+				return false
+			}
+			return true
+		})
 
-	if err == nil {
-		if blk == nil {
+		if err == nil && blk == nil {
 			err = errors.New("not found")
 		}
+
+		return loc, blk, err
 	}
 
-	return loc, blk, err
+	locs, err := br.locator.LocateReplicatedKey(key, int(o.PeerSetSize))
+	if err != nil {
+		return nil, nil, err
+	}
 
+	n := len(locs)
+	if o.ReadConsistency == ReadQuorum {
+		n = n/2 + 1
+	}
+
+	type result struct {
+		blk *structs.LogBlock
+		loc *structs.Location
+	}
+	resCh := make(chan result, len(locs))
+	for _, l := range locs[:n] {
+		go func(loc *structs.Location) {
+			b, _, err := br.logTrans.GetLogBlock(ctx, loc, key, o)
+			if err != nil {
+				resCh <- result{}
+				return
+			}
+			resCh <- result{blk: b, loc: loc}
+		}(l)
+	}
+
+	var (
+		blk    *structs.LogBlock
+		loc    *structs.Location
+		height int
+	)
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-resCh:
+			if r.blk == nil {
+				continue
+			}
+			if entries := len(r.blk.Entries()); blk == nil || entries > height {
+				blk, loc, height = r.blk, r.loc, entries
+			}
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	if blk == nil {
+		return nil, nil, errors.New("not found")
+	}
+	return loc, blk, nil
 }
 
 // GetEntry gets a LogEntryBlock from the ring.
-func (br *BlockRing) GetEntry(id []byte, opts structs.RequestOptions) (*structs.Location, *structs.LogEntryBlock, error) {
-	loc, block, err := br.GetBlock(id, opts)
+func (br *BlockRing) GetEntry(ctx context.Context, id []byte, opts structs.RequestOptions) (*structs.Location, *structs.LogEntryBlock, error) {
+	loc, block, err := br.GetBlock(ctx, id, opts)
 	if err == nil {
 		var le structs.LogEntryBlock
 		err = le.DecodeBlock(block)
@@ -180,7 +294,7 @@ func (br *BlockRing) GetEntry(id []byte, opts structs.RequestOptions) (*structs.
 }
 
 // NewEntry gets a new entry from the log.
-func (br *BlockRing) NewEntry(key []byte, opts structs.RequestOptions) (*structs.LogEntryBlock, *structs.Location, error) {
+func (br *BlockRing) NewEntry(ctx context.Context, key []byte, opts structs.RequestOptions) (*structs.LogEntryBlock, *structs.Location, error) {
 
 	locs, err := br.locator.LocateReplicatedKey(key, int(opts.PeerSetSize))
 	if err != nil {
@@ -191,7 +305,7 @@ func (br *BlockRing) NewEntry(key []byte, opts structs.RequestOptions) (*structs
 	var l *structs.Location
 	for _, loc := range locs {
 		var blk *structs.LogEntryBlock
-		if blk, _, err = br.logTrans.NewEntry(loc, key, opts); err == nil {
+		if blk, _, err = br.logTrans.NewEntry(ctx, loc, key, opts); err == nil {
 			return blk, loc, nil
 		}
 		l = loc
@@ -200,72 +314,79 @@ func (br *BlockRing) NewEntry(key []byte, opts structs.RequestOptions) (*structs
 	return nil, l, err
 }
 
-// ProposeEntry proposes a transaction to the network.
-func (br *BlockRing) ProposeEntry(tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
+// ProposeEntry proposes a transaction to the network, returning as soon as the
+// configured WriteConsistency level has been satisfied by replica acknowledgements. As
+// soon as that threshold is met, the context passed to the remaining in-flight
+// ProposeEntry calls is cancelled so they can abandon their RPCs instead of leaking
+// past the point the caller has already gotten its answer. Replicas that do respond in
+// time but with an error have that error accumulated into a multiError rather than
+// aborting the rest of the broadcast.
+func (br *BlockRing) ProposeEntry(ctx context.Context, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
 
 	locs, err := br.locator.LocateReplicatedKey(tx.Key, int(opts.PeerSetSize))
 	if err != nil {
 		return nil, err
 	}
 
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// contacted excludes opts.Source from the count: that location is skipped from the
+	// broadcast below and never sends an ack, so needed must be computed against the
+	// replicas actually contacted or it can never be satisfied by the acks loop.
+	contacted := 0
+	for _, l := range locs {
+		if opts.Source != nil && len(opts.Source) > 0 && utils.EqualBytes(l.Vnode.Id, opts.Source) {
+			continue
+		}
+		contacted++
+	}
+
 	var (
-		wg    sync.WaitGroup
-		errCh = make(chan error, len(locs))
-		done  = make(chan struct{})
-		bail  int32
-		meta  *structs.Location
+		ackCh  = make(chan *structs.Location, len(locs))
+		errCh  = make(chan error, len(locs))
+		wg     sync.WaitGroup
+		done   = make(chan struct{})
+		merr   multiError
+		needed = ackThreshold(opts.WriteConsistency, contacted, opts.N)
 	)
 
 	wg.Add(len(locs))
 
+	propose := func(loc *structs.Location, o structs.RequestOptions) {
+		defer wg.Done()
+		m, er := br.logTrans.ProposeEntry(cctx, loc, tx, o)
+		if er != nil {
+			errCh <- er
+			return
+		}
+		ackCh <- m
+	}
+
 	if opts.Source != nil && len(opts.Source) > 0 {
 		// Broadcast to all vnodes skipping the source.
 		for _, l := range locs {
-			// 1 go-routine per location
-			go func(loc *structs.Location) {
-
-				if atomic.LoadInt32(&bail) == 0 {
-					if !utils.EqualBytes(loc.Vnode.Id, opts.Source) {
-						o := structs.RequestOptions{
-							Destination: loc.Vnode.Id,
-							Source:      opts.Source,
-							PeerSetSize: opts.PeerSetSize,
-							PeerSetKey:  loc.Id,
-						}
-						if _, er := br.logTrans.ProposeEntry(loc, tx, o); er != nil {
-							errCh <- er
-						}
-
-					}
-				}
+			if utils.EqualBytes(l.Vnode.Id, opts.Source) {
 				wg.Done()
-
-			}(l)
-
+				continue
+			}
+			go propose(l, structs.RequestOptions{
+				Destination: l.Vnode.Id,
+				Source:      opts.Source,
+				PeerSetSize: opts.PeerSetSize,
+				PeerSetKey:  l.Id,
+			})
 		}
 
 	} else {
 		// Broadcast to all vnodes
 		for _, l := range locs {
-
-			go func(loc *structs.Location) {
-
-				if atomic.LoadInt32(&bail) == 0 {
-					o := structs.RequestOptions{
-						Destination: loc.Vnode.Id,
-						Source:      loc.Vnode.Id,
-						PeerSetSize: opts.PeerSetSize,
-						PeerSetKey:  loc.Id,
-					}
-					if _, er := br.logTrans.ProposeEntry(loc, tx, o); er != nil {
-						errCh <- er
-					}
-				}
-
-				wg.Done()
-
-			}(l)
-
+			go propose(l, structs.RequestOptions{
+				Destination: l.Vnode.Id,
+				Source:      l.Vnode.Id,
+				PeerSetSize: opts.PeerSetSize,
+				PeerSetKey:  l.Id,
+			})
 		}
 
 	}
@@ -275,17 +396,45 @@ func (br *BlockRing) ProposeEntry(tx *structs.LogEntryBlock, opts structs.Reques
 		close(done)
 	}()
 
-	select {
-	case <-done:
-	case err = <-errCh:
-		atomic.StoreInt32(&bail, 1)
+	var (
+		acks int
+		meta *structs.Location
+	)
+	for acks < needed {
+		select {
+		case m := <-ackCh:
+			acks++
+			meta = m
+		case er := <-errCh:
+			merr.Add(er)
+		case <-done:
+			for acks < needed {
+				select {
+				case m := <-ackCh:
+					acks++
+					meta = m
+				case er := <-errCh:
+					merr.Add(er)
+				default:
+					return meta, merr.ErrorOrNil()
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	return meta, err
+	// Quorum reached: cancel the remaining in-flight ProposeEntry calls via the
+	// deferred cancel() and return immediately rather than waiting on wg.
+	return meta, merr.ErrorOrNil()
 }
 
-// CommitEntry tries to commit an entry
-func (br *BlockRing) CommitEntry(tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
+// CommitEntry commits tx to every replica in the range, retrying a replica that errors
+// rather than bailing out on the first one: once any replica has committed the entry the
+// write is already final, so a straggler must never cause CommitEntry to abandon or roll
+// back the replicas that already succeeded. Mirrors LogRing.CommitTx's retry/no-abort-
+// on-commit semantics.
+func (br *BlockRing) CommitEntry(ctx context.Context, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
 	locs, err := br.locator.LocateReplicatedKey(tx.Key, int(opts.PeerSetSize))
 	if err != nil {
 		return nil, err
@@ -293,7 +442,23 @@ func (br *BlockRing) CommitEntry(tx *structs.LogEntryBlock, opts structs.Request
 
 	// TODO: call concurrently
 
-	var meta *structs.Location
+	var (
+		meta      *structs.Location
+		committed int
+		merr      multiError
+	)
+
+	commit := func(loc *structs.Location, o structs.RequestOptions) {
+		//log.Printf("action=commit src=%x dst=%s", o.Source, utils.ShortVnodeID(loc.Vnode))
+		m, er := br.commitEntryWithRetry(ctx, loc, tx, o)
+		if er != nil {
+			merr.Add(fmt.Errorf("commit to %x: %w", loc.Vnode.Id, er))
+			return
+		}
+		meta = m
+		committed++
+	}
+
 	if opts.Source != nil && len(opts.Source) > 0 {
 		// Broadcast to all vnodes skipping the source.
 		for _, loc := range locs {
@@ -301,29 +466,68 @@ func (br *BlockRing) CommitEntry(tx *structs.LogEntryBlock, opts structs.Request
 				continue
 			}
 
-			opts.Destination = loc.Vnode.Id
-			opts.PeerSetKey = loc.Id
-			//log.Printf("action=commit src=%x dst=%s", opts.Source, utils.ShortVnodeID(loc.Vnode))
-			if _, er := br.logTrans.CommitEntry(loc, tx, opts); er != nil {
-				err = er
-				break
-			}
+			o := opts
+			o.Destination = loc.Vnode.Id
+			o.PeerSetKey = loc.Id
+			commit(loc, o)
 		}
 
 	} else {
 		// Broadcast to all vnodes
 		for _, loc := range locs {
-			opts.Source = loc.Vnode.Id
-			opts.Destination = loc.Vnode.Id
-			opts.PeerSetKey = loc.Id
-			//log.Printf("action=commit src=%x dst=%s", opts.Source, utils.ShortVnodeID(loc.Vnode))
-			if _, er := br.logTrans.CommitEntry(loc, tx, opts); er != nil {
-				err = er
-				break
+			o := opts
+			o.Source = loc.Vnode.Id
+			o.Destination = loc.Vnode.Id
+			o.PeerSetKey = loc.Id
+			commit(loc, o)
+		}
+
+	}
+
+	if committed == 0 {
+		return nil, merr.ErrorOrNil()
+	}
+
+	// At least one replica committed, so the entry is already final: stragglers above
+	// are left for anti-entropy to reconcile later rather than rolled back.
+	return meta, nil
+}
+
+// commitEntryWithRetry retries a single replica's CommitEntry up to commitRetryAttempts
+// times, mirroring LogRing.commitWithRetry: a straggler that failed once may simply be
+// transiently slow, not divergent.
+func (br *BlockRing) commitEntryWithRetry(ctx context.Context, loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
+	var lastErr error
+	for attempt := 0; attempt < commitRetryAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(commitRetryBackoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
 			}
 		}
 
+		m, err := br.logTrans.CommitEntry(ctx, loc, tx, opts)
+		if err == nil {
+			return m, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Sync fast-syncs keyRange against the given peer locations, using a skeleton of
+// headers followed by a parallel fill of the gaps between skeleton anchors. progress,
+// if non-nil, is invoked as entries are filled in.
+func (br *BlockRing) Sync(ctx context.Context, keyRange structs.KeyRange, peers []*structs.Location, progress blksync.ProgressFunc) error {
+	if len(peers) == 0 {
+		return errors.New("sync: no peers supplied")
+	}
+
+	syncPeers := make([]*blksync.Peer, len(peers))
+	for i, loc := range peers {
+		syncPeers[i] = &blksync.Peer{Location: loc, Log: br.logTrans, Block: br.blkTrans}
 	}
 
-	return meta, err
+	return blksync.New(progress).Sync(ctx, keyRange, syncPeers)
 }
@@ -0,0 +1,106 @@
+package blockring
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/hexablock/blockring/structs"
+)
+
+// fakeEntryTransport is a LogTransport (blockring.go's ProposeEntry/CommitEntry variant)
+// whose CommitEntry failures are driven by a per-vnode retry budget, mirroring
+// fakeLogTransport's commitFail in logring_test.go.
+type fakeEntryTransport struct {
+	mu          sync.Mutex
+	commitFail  map[string]int
+	commitCalls map[string]int
+}
+
+func newFakeEntryTransport() *fakeEntryTransport {
+	return &fakeEntryTransport{
+		commitFail:  make(map[string]int),
+		commitCalls: make(map[string]int),
+	}
+}
+
+func (f *fakeEntryTransport) ProposeEntry(ctx context.Context, loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
+	return nil, errors.New("not used in this test")
+}
+
+func (f *fakeEntryTransport) NewEntry(ctx context.Context, loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogEntryBlock, *structs.Location, error) {
+	return nil, nil, errors.New("not used in this test")
+}
+
+func (f *fakeEntryTransport) CommitEntry(ctx context.Context, loc *structs.Location, tx *structs.LogEntryBlock, opts structs.RequestOptions) (*structs.Location, error) {
+	f.mu.Lock()
+	id := string(loc.Vnode.Id)
+	f.commitCalls[id]++
+	remaining := f.commitFail[id]
+	if remaining > 0 {
+		f.commitFail[id] = remaining - 1
+	}
+	f.mu.Unlock()
+
+	if remaining > 0 {
+		return nil, errors.New("commit failed")
+	}
+	return loc, nil
+}
+
+func (f *fakeEntryTransport) GetLogBlock(ctx context.Context, loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogBlock, *structs.Location, error) {
+	return nil, nil, errors.New("not used in this test")
+}
+
+func (f *fakeEntryTransport) GetHeaderSkeleton(ctx context.Context, loc *structs.Location, keyRange structs.KeyRange, step int) ([]*structs.LogEntryBlock, error) {
+	return nil, errors.New("not used in this test")
+}
+
+func (f *fakeEntryTransport) GetHeaderRange(ctx context.Context, loc *structs.Location, start, end []byte) ([]*structs.LogEntryBlock, error) {
+	return nil, errors.New("not used in this test")
+}
+
+func (f *fakeEntryTransport) callsFor(id byte) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.commitCalls[string([]byte{id})]
+}
+
+// CommitEntry itself relocates replicas via locator.LocateReplicatedKey before
+// delegating per-location, so (like ProposeTx pre-refactor) it can't be driven without a
+// Locator; these tests exercise commitEntryWithRetry directly, the piece CommitEntry
+// relies on for the retry/no-abort-on-commit behavior called out in review.
+func TestCommitEntryWithRetryRetriesThenSucceeds(t *testing.T) {
+	trans := newFakeEntryTransport()
+	trans.commitFail[string([]byte{'A'})] = 2
+
+	br := &BlockRing{logTrans: trans}
+	tx := &structs.LogEntryBlock{Key: []byte("k1")}
+
+	meta, err := br.commitEntryWithRetry(context.Background(), locWithID('A'), tx, structs.RequestOptions{})
+	if err != nil {
+		t.Fatalf("commitEntryWithRetry returned an error: %v", err)
+	}
+	if meta == nil {
+		t.Fatal("expected a non-nil location on eventual success")
+	}
+	if trans.callsFor('A') != 3 {
+		t.Fatalf("expected 3 CommitEntry attempts (2 failures + 1 success), got %d", trans.callsFor('A'))
+	}
+}
+
+func TestCommitEntryWithRetryGivesUpAfterCommitRetryAttempts(t *testing.T) {
+	trans := newFakeEntryTransport()
+	trans.commitFail[string([]byte{'B'})] = commitRetryAttempts
+
+	br := &BlockRing{logTrans: trans}
+	tx := &structs.LogEntryBlock{Key: []byte("k1")}
+
+	if _, err := br.commitEntryWithRetry(context.Background(), locWithID('B'), tx, structs.RequestOptions{}); err == nil {
+		t.Fatal("expected commitEntryWithRetry to surface a persistent failure")
+	}
+	if trans.callsFor('B') != commitRetryAttempts {
+		t.Fatalf("expected exactly %d attempts, got %d", commitRetryAttempts, trans.callsFor('B'))
+	}
+}
@@ -0,0 +1,80 @@
+package blockring
+
+import "fmt"
+
+// WriteConsistency controls how many replica acknowledgements a write (ProposeTx,
+// ProposeEntry) must collect before it is considered successful.
+type WriteConsistency int
+
+const (
+	// WriteOne succeeds as soon as a single replica acknowledges the write.
+	WriteOne WriteConsistency = iota
+	// WriteQuorum succeeds once floor(PeerSetSize/2)+1 replicas acknowledge the write.
+	WriteQuorum
+	// WriteAll requires every replica in the peer set to acknowledge the write.
+	WriteAll
+	// WriteN requires a caller supplied number (N) of replicas to acknowledge the write.
+	WriteN
+)
+
+// ReadConsistency controls how many replicas a read (GetTx, GetLogBlock, GetEntry) is
+// queried against before the newest result is returned.
+type ReadConsistency int
+
+const (
+	// ReadOne returns the first successful response from a single replica.
+	ReadOne ReadConsistency = iota
+	// ReadQuorum queries floor(PeerSetSize/2)+1 replicas in parallel and returns the
+	// newest response.
+	ReadQuorum
+	// ReadAll queries every replica in the peer set and returns the newest response.
+	ReadAll
+)
+
+// ackThreshold returns the number of replica acknowledgements required to satisfy the
+// given write consistency level out of a peer set of size n.
+func ackThreshold(wc WriteConsistency, n, reqN int) int {
+	switch wc {
+	case WriteAll:
+		return n
+	case WriteN:
+		if reqN <= 0 || reqN > n {
+			return n
+		}
+		return reqN
+	case WriteQuorum:
+		return n/2 + 1
+	default:
+		return 1
+	}
+}
+
+// multiError accumulates per-replica errors encountered while fanning a request out to
+// a peer set, without aborting the remaining in-flight requests.
+type multiError struct {
+	errs []error
+}
+
+func (m *multiError) Add(err error) {
+	if err != nil {
+		m.errs = append(m.errs, err)
+	}
+}
+
+func (m *multiError) ErrorOrNil() error {
+	if len(m.errs) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *multiError) Error() string {
+	if len(m.errs) == 1 {
+		return m.errs[0].Error()
+	}
+	s := fmt.Sprintf("%d errors occurred:", len(m.errs))
+	for _, e := range m.errs {
+		s += "\n\t* " + e.Error()
+	}
+	return s
+}
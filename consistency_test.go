@@ -0,0 +1,60 @@
+package blockring
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAckThreshold(t *testing.T) {
+	cases := []struct {
+		name string
+		wc   WriteConsistency
+		n    int
+		reqN int
+		want int
+	}{
+		{"one", WriteOne, 5, 0, 1},
+		{"quorum odd", WriteQuorum, 5, 0, 3},
+		{"quorum even", WriteQuorum, 4, 0, 3},
+		{"quorum single peer", WriteQuorum, 1, 0, 1},
+		{"all", WriteAll, 5, 0, 5},
+		{"n within range", WriteN, 5, 3, 3},
+		{"n zero falls back to all", WriteN, 5, 0, 5},
+		{"n negative falls back to all", WriteN, 5, -1, 5},
+		{"n exceeding peer set falls back to all", WriteN, 5, 6, 5},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ackThreshold(c.wc, c.n, c.reqN); got != c.want {
+				t.Fatalf("ackThreshold(%v, %d, %d) = %d, want %d", c.wc, c.n, c.reqN, got, c.want)
+			}
+		})
+	}
+}
+
+func TestMultiErrorErrorOrNil(t *testing.T) {
+	var merr multiError
+	if merr.ErrorOrNil() != nil {
+		t.Fatal("ErrorOrNil should be nil with no errors added")
+	}
+
+	merr.Add(nil)
+	if merr.ErrorOrNil() != nil {
+		t.Fatal("Add(nil) should not count as an error")
+	}
+
+	merr.Add(errors.New("boom"))
+	if err := merr.ErrorOrNil(); err == nil || err.Error() != "boom" {
+		t.Fatalf("a single error should surface unwrapped, got %v", err)
+	}
+
+	merr.Add(errors.New("bang"))
+	err := merr.ErrorOrNil()
+	if err == nil {
+		t.Fatal("expected a combined error")
+	}
+	if err.Error() == "boom" {
+		t.Fatal("multiple errors should not collapse to the first one's message")
+	}
+}
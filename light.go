@@ -0,0 +1,271 @@
+package blockring
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/hexablock/blockring/structs"
+	"github.com/hexablock/txlog"
+)
+
+// ODRBackend retrieves ring data on demand for a light client that does not store
+// replicas itself, modeled on go-ethereum's on-demand retrieval (ODR) backend. Two
+// retrieval strategies are supported: take the first of N peers to respond, or fetch
+// with a Merkle proof that can be verified against a trusted root without trusting any
+// single replica.
+type ODRBackend interface {
+	// RetrieveTx fetches a tx from up to N peers, taking the first successful response.
+	RetrieveTx(ctx context.Context, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error)
+	// RetrieveTxWithProof fetches a tx along with an inclusion proof chaining it to root.
+	RetrieveTxWithProof(ctx context.Context, hash []byte, root []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, *MerkleProof, error)
+	// RetrieveLogBlock fetches a LogBlock for key from up to N peers.
+	RetrieveLogBlock(ctx context.Context, key []byte, opts structs.RequestOptions) (*structs.LogBlock, error)
+	// RetrieveBlock fetches a Block by id, along with an inclusion proof chaining it to
+	// root, from up to N peers.
+	RetrieveBlock(ctx context.Context, id []byte, root []byte, opts structs.RequestOptions) (*structs.Block, *MerkleProof, error)
+}
+
+// MerkleProofStep is one sibling hash on the path from a leaf to the root, plus the
+// orientation needed to combine it correctly: the tree hashes sha256(left || right), so
+// a step must record whether the sibling is the left or right child at that level.
+type MerkleProofStep struct {
+	// Sibling is the sibling hash at this level.
+	Sibling []byte
+	// IsLeft is true if Sibling is the left child, i.e. the running hash must be
+	// combined as sha256(Sibling || h) rather than sha256(h || Sibling).
+	IsLeft bool
+}
+
+// MerkleProof is an inclusion proof returned alongside data fetched via an ODRBackend,
+// letting a light client verify the data chains to a committed RootBlock hash without
+// storing the underlying log or block.
+type MerkleProof struct {
+	// Path holds the sibling hashes, with orientation, on the way from the leaf to the
+	// root.
+	Path []MerkleProofStep
+}
+
+// Verify walks the proof from leaf up to root, returning true if it reconstructs root.
+func (p *MerkleProof) Verify(leaf, root []byte) bool {
+	h := leaf
+	for _, step := range p.Path {
+		var sum [32]byte
+		if step.IsLeft {
+			sum = sha256.Sum256(append(append([]byte{}, step.Sibling...), h...))
+		} else {
+			sum = sha256.Sum256(append(append([]byte{}, h...), step.Sibling...))
+		}
+		h = sum[:]
+	}
+	return string(h) == string(root)
+}
+
+// lruCache is a small fixed-capacity LRU used to avoid re-verifying and re-fetching
+// data a light client has already retrieved.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	val interface{}
+}
+
+func newLRUCache(capacity int) *lruCache {
+	if capacity <= 0 {
+		capacity = 256
+	}
+	return &lruCache{capacity: capacity, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*lruEntry).val, true
+	}
+	return nil, false
+}
+
+func (c *lruCache) Add(key string, val interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*lruEntry).val = val
+		return
+	}
+
+	el := c.ll.PushFront(&lruEntry{key: key, val: val})
+	c.items[key] = el
+
+	if c.ll.Len() > c.capacity {
+		oldest := c.ll.Back()
+		if oldest != nil {
+			c.ll.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+// txCacheEntry holds the pair retrieved and verified for a hash, so a cache hit returns
+// the same (tx, meta) a cache miss would have.
+type txCacheEntry struct {
+	tx   *txlog.Tx
+	meta *txlog.Meta
+}
+
+// LightLogRing is a resource-constrained LogRing variant that does not participate in
+// ProposeTx/CommitTx quorums or store replicas, but serves GetTx by retrieving data on
+// demand from peers via an ODRBackend and verifying it against a trusted root, modeled
+// on go-ethereum's light client.
+type LightLogRing struct {
+	odr ODRBackend
+
+	mu   sync.RWMutex
+	root []byte
+
+	cache *lruCache
+}
+
+// NewLightLogRing instantiates a LightLogRing that verifies retrieved txs against root
+// and caches up to cacheSize verified results.
+func NewLightLogRing(odr ODRBackend, root []byte, cacheSize int) *LightLogRing {
+	return &LightLogRing{odr: odr, root: root, cache: newLRUCache(cacheSize)}
+}
+
+// SetRoot updates the trusted root a LightLogRing verifies proofs against, e.g. after a
+// new RootBlock is committed. Safe to call concurrently with GetTx/GetTxFast.
+func (l *LightLogRing) SetRoot(root []byte) {
+	l.mu.Lock()
+	l.root = root
+	l.mu.Unlock()
+}
+
+func (l *LightLogRing) trustedRoot() []byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.root
+}
+
+// GetTx retrieves a tx by hash. If a proof-verified result is already in cache it is
+// returned directly; otherwise the tx is fetched with an inclusion proof and verified
+// against the trusted root before being cached and returned.
+func (l *LightLogRing) GetTx(ctx context.Context, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	if v, ok := l.cache.Get(string(hash)); ok {
+		entry := v.(*txCacheEntry)
+		return entry.tx, entry.meta, nil
+	}
+
+	root := l.trustedRoot()
+	tx, meta, proof, err := l.odr.RetrieveTxWithProof(ctx, hash, root, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proof == nil || !proof.Verify(hash, root) {
+		return nil, nil, fmt.Errorf("light: proof verification failed for tx %x", hash)
+	}
+
+	l.cache.Add(string(hash), &txCacheEntry{tx: tx, meta: meta})
+	return tx, meta, nil
+}
+
+// GetTxFast retrieves a tx by hash using the take-first-of-N-peers strategy instead of
+// requiring and verifying an inclusion proof. It trades the byzantine guarantee GetTx
+// gives for latency, and is meant for callers that already apply their own trust model
+// on top (e.g. anti-entropy reconciliation pulling from a known-good replica set), not
+// as a general substitute for GetTx. Results are not cached, since they are unverified.
+func (l *LightLogRing) GetTxFast(ctx context.Context, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	return l.odr.RetrieveTx(ctx, hash, opts)
+}
+
+// LightBlockRing is a resource-constrained BlockRing variant that serves GetBlock and
+// GetLogBlock/GetEntry by retrieving data on demand via an ODRBackend instead of
+// participating in replication.
+type LightBlockRing struct {
+	odr ODRBackend
+
+	mu   sync.RWMutex
+	root []byte
+
+	cache *lruCache
+}
+
+// NewLightBlockRing instantiates a LightBlockRing that verifies retrieved blocks
+// against root and caches up to cacheSize verified results.
+func NewLightBlockRing(odr ODRBackend, root []byte, cacheSize int) *LightBlockRing {
+	return &LightBlockRing{odr: odr, root: root, cache: newLRUCache(cacheSize)}
+}
+
+// SetRoot updates the trusted root a LightBlockRing verifies proofs against. Safe to
+// call concurrently with GetBlock/GetEntry.
+func (l *LightBlockRing) SetRoot(root []byte) {
+	l.mu.Lock()
+	l.root = root
+	l.mu.Unlock()
+}
+
+func (l *LightBlockRing) trustedRoot() []byte {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.root
+}
+
+// GetBlock retrieves a block by id, verifying its inclusion proof against the trusted
+// root before caching and returning it.
+func (l *LightBlockRing) GetBlock(ctx context.Context, id []byte, opts ...structs.RequestOptions) (*structs.Block, error) {
+	o := *structs.DefaultRequestOptions()
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+
+	if v, ok := l.cache.Get(string(id)); ok {
+		return v.(*structs.Block), nil
+	}
+
+	root := l.trustedRoot()
+	blk, proof, err := l.odr.RetrieveBlock(ctx, id, root, o)
+	if err != nil {
+		return nil, err
+	}
+	if proof == nil || !proof.Verify(id, root) {
+		return nil, fmt.Errorf("light: proof verification failed for block %x", id)
+	}
+
+	l.cache.Add(string(id), blk)
+	return blk, nil
+}
+
+// GetLogBlock retrieves the LogBlock for key, taking the first of the configured peer
+// set to respond; no inclusion proof is required since a LogBlock header is already
+// verified indirectly when its entries are retrieved via GetTx.
+func (l *LightBlockRing) GetLogBlock(ctx context.Context, key []byte, opts ...structs.RequestOptions) (*structs.LogBlock, error) {
+	o := *structs.DefaultRequestOptions()
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	return l.odr.RetrieveLogBlock(ctx, key, o)
+}
+
+// GetEntry retrieves a LogEntryBlock by id, verifying it against the trusted root.
+func (l *LightBlockRing) GetEntry(ctx context.Context, id []byte, opts structs.RequestOptions) (*structs.LogEntryBlock, error) {
+	blk, err := l.GetBlock(ctx, id, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var le structs.LogEntryBlock
+	if err = le.DecodeBlock(blk); err != nil {
+		return nil, err
+	}
+	return &le, nil
+}
@@ -0,0 +1,209 @@
+package blockring
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/hexablock/blockring/structs"
+	"github.com/hexablock/txlog"
+)
+
+// fakeODR is an ODRBackend whose Retrieve* calls return whatever the test has stashed,
+// and counts how many times each was called so a test can assert a cache hit skipped the
+// network round trip entirely.
+type fakeODR struct {
+	tx                       *txlog.Tx
+	meta                     *txlog.Meta
+	txProof                  *MerkleProof
+	txErr                    error
+	retrieveTxWithProofCalls int
+
+	blk                *structs.Block
+	blkProof           *MerkleProof
+	blkErr             error
+	retrieveBlockCalls int
+}
+
+func (f *fakeODR) RetrieveTx(ctx context.Context, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	return f.tx, f.meta, f.txErr
+}
+
+func (f *fakeODR) RetrieveTxWithProof(ctx context.Context, hash []byte, root []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, *MerkleProof, error) {
+	f.retrieveTxWithProofCalls++
+	return f.tx, f.meta, f.txProof, f.txErr
+}
+
+func (f *fakeODR) RetrieveLogBlock(ctx context.Context, key []byte, opts structs.RequestOptions) (*structs.LogBlock, error) {
+	return nil, errors.New("not used in this test")
+}
+
+func (f *fakeODR) RetrieveBlock(ctx context.Context, id []byte, root []byte, opts structs.RequestOptions) (*structs.Block, *MerkleProof, error) {
+	f.retrieveBlockCalls++
+	return f.blk, f.blkProof, f.blkErr
+}
+
+// leafHash and parentHash build a tiny two-leaf tree by hand so MerkleProof tests don't
+// depend on any production tree-building code.
+func leafHash(b byte) []byte {
+	sum := sha256.Sum256([]byte{b})
+	return sum[:]
+}
+
+func parentHash(left, right []byte) []byte {
+	sum := sha256.Sum256(append(append([]byte{}, left...), right...))
+	return sum[:]
+}
+
+func TestMerkleProofVerifyLeftChild(t *testing.T) {
+	left, right := leafHash('A'), leafHash('B')
+	root := parentHash(left, right)
+
+	proof := &MerkleProof{Path: []MerkleProofStep{{Sibling: right, IsLeft: false}}}
+	if !proof.Verify(left, root) {
+		t.Fatal("expected a left-child leaf's proof to verify")
+	}
+}
+
+func TestMerkleProofVerifyRightChild(t *testing.T) {
+	left, right := leafHash('A'), leafHash('B')
+	root := parentHash(left, right)
+
+	proof := &MerkleProof{Path: []MerkleProofStep{{Sibling: left, IsLeft: true}}}
+	if !proof.Verify(right, root) {
+		t.Fatal("expected a right-child leaf's proof to verify")
+	}
+}
+
+func TestMerkleProofVerifyRejectsTamperedSibling(t *testing.T) {
+	left, right := leafHash('A'), leafHash('B')
+	root := parentHash(left, right)
+
+	tampered := &MerkleProof{Path: []MerkleProofStep{{Sibling: leafHash('Z'), IsLeft: false}}}
+	if tampered.Verify(left, root) {
+		t.Fatal("expected a tampered sibling to fail verification")
+	}
+}
+
+func TestMerkleProofVerifyRejectsWrongRoot(t *testing.T) {
+	left, right := leafHash('A'), leafHash('B')
+
+	proof := &MerkleProof{Path: []MerkleProofStep{{Sibling: right, IsLeft: false}}}
+	if proof.Verify(left, leafHash('Z')) {
+		t.Fatal("expected verification against the wrong root to fail")
+	}
+}
+
+func TestLRUCacheEvictsOldestBeyondCapacity(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Add("c", 3) // evicts "a", the least recently touched
+
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expected \"a\" to have been evicted")
+	}
+	if v, ok := c.Get("b"); !ok || v != 2 {
+		t.Fatalf("expected \"b\" to still be cached, got %v, %v", v, ok)
+	}
+	if v, ok := c.Get("c"); !ok || v != 3 {
+		t.Fatalf("expected \"c\" to still be cached, got %v, %v", v, ok)
+	}
+}
+
+func TestLRUCacheGetRefreshesRecency(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a")    // touch "a" so it is no longer the least recently used
+	c.Add("c", 3) // must evict "b", not "a"
+
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("expected \"b\" to have been evicted after \"a\" was refreshed by Get")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected \"a\" to survive since Get refreshed its recency")
+	}
+}
+
+func TestLRUCacheAddOverwritesExistingKey(t *testing.T) {
+	c := newLRUCache(2)
+	c.Add("a", 1)
+	c.Add("a", 2)
+
+	if v, ok := c.Get("a"); !ok || v != 2 {
+		t.Fatalf("expected Add to overwrite the existing value, got %v, %v", v, ok)
+	}
+	if c.ll.Len() != 1 {
+		t.Fatalf("expected overwriting a key not to grow the list, got length %d", c.ll.Len())
+	}
+}
+
+func TestLightLogRingGetTxCacheHitSkipsODR(t *testing.T) {
+	odr := &fakeODR{}
+	l := NewLightLogRing(odr, []byte("root"), 16)
+	l.cache.Add(string([]byte("h1")), &txCacheEntry{tx: &txlog.Tx{Key: []byte("k1")}, meta: &txlog.Meta{}})
+
+	tx, _, err := l.GetTx(context.Background(), []byte("h1"), txlog.Options{})
+	if err != nil {
+		t.Fatalf("GetTx returned an error on a cache hit: %v", err)
+	}
+	if tx == nil || string(tx.Key) != "k1" {
+		t.Fatalf("expected the cached tx to be returned, got %v", tx)
+	}
+	if odr.retrieveTxWithProofCalls != 0 {
+		t.Fatalf("expected a cache hit not to call the ODRBackend, got %d calls", odr.retrieveTxWithProofCalls)
+	}
+}
+
+func TestLightLogRingGetTxRejectsFailedProof(t *testing.T) {
+	root := []byte("root")
+	odr := &fakeODR{
+		tx:      &txlog.Tx{Key: []byte("k1")},
+		meta:    &txlog.Meta{},
+		txProof: &MerkleProof{Path: []MerkleProofStep{{Sibling: []byte("wrong-sibling")}}},
+	}
+	l := NewLightLogRing(odr, root, 16)
+
+	if _, _, err := l.GetTx(context.Background(), []byte("h1"), txlog.Options{}); err == nil {
+		t.Fatal("expected GetTx to reject a tx whose proof does not verify against root")
+	}
+	if odr.retrieveTxWithProofCalls != 1 {
+		t.Fatalf("expected exactly one RetrieveTxWithProof call, got %d", odr.retrieveTxWithProofCalls)
+	}
+}
+
+func TestLightBlockRingGetBlockCacheHitSkipsODR(t *testing.T) {
+	odr := &fakeODR{}
+	l := NewLightBlockRing(odr, []byte("root"), 16)
+	want := &structs.Block{}
+	l.cache.Add(string([]byte("id1")), want)
+
+	blk, err := l.GetBlock(context.Background(), []byte("id1"))
+	if err != nil {
+		t.Fatalf("GetBlock returned an error on a cache hit: %v", err)
+	}
+	if blk != want {
+		t.Fatalf("expected the cached block to be returned, got %v", blk)
+	}
+	if odr.retrieveBlockCalls != 0 {
+		t.Fatalf("expected a cache hit not to call the ODRBackend, got %d calls", odr.retrieveBlockCalls)
+	}
+}
+
+func TestLightBlockRingGetBlockRejectsFailedProof(t *testing.T) {
+	root := []byte("root")
+	odr := &fakeODR{
+		blk:      &structs.Block{},
+		blkProof: &MerkleProof{Path: []MerkleProofStep{{Sibling: []byte("wrong-sibling")}}},
+	}
+	l := NewLightBlockRing(odr, root, 16)
+
+	if _, err := l.GetBlock(context.Background(), []byte("id1")); err == nil {
+		t.Fatal("expected GetBlock to reject a block whose proof does not verify against root")
+	}
+	if odr.retrieveBlockCalls != 1 {
+		t.Fatalf("expected exactly one RetrieveBlock call, got %d", odr.retrieveBlockCalls)
+	}
+}
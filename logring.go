@@ -1,21 +1,42 @@
 package blockring
 
 import (
+	"context"
 	"fmt"
 	"sync"
-	"sync/atomic"
+	"time"
 
+	"github.com/hexablock/blockring/antientropy"
 	"github.com/hexablock/blockring/rpc"
 	"github.com/hexablock/blockring/structs"
 	"github.com/hexablock/txlog"
 	"github.com/ipkg/difuse/utils"
 )
 
+// LogTransport implements a transport for the distributed log. Every method takes a
+// context as its first parameter so a caller can cancel a slow fan-out, enforce a
+// per-request deadline, or propagate a tracing ID down to the wire.
 type LogTransport interface {
-	ProposeTx(loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error)
-	NewTx(loc *structs.Location, key []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error)
-	GetTx(loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error)
-	CommitTx(loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error)
+	// ProposeTx is the Prepare phase of the two-phase commit: it locks key on the
+	// replica and returns the replica's vote as a txlog.Meta in StatePrepared.
+	ProposeTx(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error)
+	NewTx(ctx context.Context, loc *structs.Location, key []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error)
+	GetTx(ctx context.Context, loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error)
+	// CommitTx is the Commit phase; it only succeeds on a replica that has already
+	// prepared tx.
+	CommitTx(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error)
+	// AbortTx releases a replica's Prepare lock on tx and discards the pending entry,
+	// driving it to StateAborted. It is a no-op on a replica that never prepared tx.
+	AbortTx(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) error
+	// GetTxWithProof returns the tx at hash along with a Merkle inclusion proof chaining
+	// it to the committed root, for use by light clients that do not store the log.
+	GetTxWithProof(ctx context.Context, loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, *MerkleProof, error)
+	// RangeDigest returns the Merkle digest of {key -> latest txlog.Meta.Hash} pairs
+	// for [rangeStart, rangeEnd) at depth, for use by the anti-entropy reconciliation
+	// loop. path is the chain of bucket-prefix bytes chosen by the caller's descent from
+	// the root digest down to this node (nil at the root), letting the replica build the
+	// digest for exactly the subtree the caller is resolving rather than the whole range.
+	RangeDigest(ctx context.Context, loc *structs.Location, rangeStart, rangeEnd []byte, depth int, path []byte) (*antientropy.Digest, error)
 }
 
 // LogRing is the core interface to perform operations around the ring.
@@ -44,160 +65,372 @@ func NewLogRing(locator Locator, trans LogTransport, ch chan<- *rpc.BlockRPCData
 	return rs
 }
 
-func (lr *LogRing) NewTx(key []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+func (lr *LogRing) NewTx(ctx context.Context, key []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
 	keyHash, _, succs, err := lr.locator.LookupKey(key, 1)
 	if err != nil {
 		return nil, nil, err
 	}
 	loc := &structs.Location{Id: keyHash, Vnode: succs[0]}
-	return lr.transport.NewTx(loc, key, opts)
+	return lr.transport.NewTx(ctx, loc, key, opts)
 }
 
-// ProposeTx proposes a transaction to the network.
-func (lr *LogRing) ProposeTx(tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error) {
+// ProposeTx is the Prepare phase of the two-phase commit protocol: it fans tx out to
+// the replica set and returns as soon as the configured WriteConsistency level has been
+// satisfied by replica Prepare votes. As soon as that threshold is met, the context
+// passed to the remaining in-flight ProposeTx calls is cancelled so they can abandon
+// their RPCs instead of leaking past the point the caller has already gotten its
+// answer. Replicas that do respond in time but with an error have that error
+// accumulated into a multiError rather than aborting the rest of the broadcast.
+//
+// The returned locations are exactly the replicas that voted Prepare before ProposeTx
+// returned; CommitTx must be called with that slice so it never commits or aborts a
+// replica that never prepared tx.
+func (lr *LogRing) ProposeTx(ctx context.Context, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, []*structs.Location, error) {
 
 	locs, err := lr.locator.LocateReplicatedKey(tx.Key, int(opts.PeerSetSize))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	return lr.proposeCohort(ctx, locs, tx, opts)
+}
+
+// proposeCohort runs the Prepare fan-out of ProposeTx against an already-located replica
+// set. Split out from ProposeTx so the quorum/cancellation/eager-abort logic can be
+// exercised directly against a fake LogTransport without a Locator.
+func (lr *LogRing) proposeCohort(ctx context.Context, locs []*structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, []*structs.Location, error) {
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// contacted excludes opts.Source from the count: that location is skipped from the
+	// broadcast below and never sends an ack, so needed must be computed against the
+	// replicas actually contacted or it can never be satisfied by the acks loop.
+	contacted := 0
+	for _, l := range locs {
+		if opts.Source != nil && len(opts.Source) > 0 && utils.EqualBytes(l.Vnode.Id, opts.Source) {
+			continue
+		}
+		contacted++
+	}
+
+	type prepareAck struct {
+		loc  *structs.Location
+		meta *txlog.Meta
 	}
 
 	var (
-		wg    sync.WaitGroup
-		errCh = make(chan error, len(locs))
-		done  = make(chan struct{})
-		bail  int32
-		meta  *txlog.Meta
+		ackCh  = make(chan prepareAck, len(locs))
+		errCh  = make(chan error, len(locs))
+		wg     sync.WaitGroup
+		done   = make(chan struct{})
+		merr   multiError
+		needed = ackThreshold(opts.WriteConsistency, contacted, opts.N)
 	)
 
 	wg.Add(len(locs))
 
+	propose := func(loc *structs.Location, o txlog.Options) {
+		defer wg.Done()
+		m, er := lr.transport.ProposeTx(cctx, loc, tx, o)
+		if er != nil {
+			errCh <- er
+			return
+		}
+		ackCh <- prepareAck{loc: loc, meta: m}
+	}
+
 	if opts.Source != nil && len(opts.Source) > 0 {
 		// Broadcast to all vnodes skipping the source.
 		for _, l := range locs {
-			// 1 go-routine per location
-			go func(loc *structs.Location) {
-
-				if atomic.LoadInt32(&bail) == 0 {
-					if !utils.EqualBytes(loc.Vnode.Id, opts.Source) {
-						o := txlog.Options{
-							Destination: loc.Vnode.Id,
-							Source:      opts.Source,
-							PeerSetSize: opts.PeerSetSize,
-						}
-						if _, er := lr.transport.ProposeTx(loc, tx, o); er != nil {
-							errCh <- er
-						}
-
-					}
-				}
+			if utils.EqualBytes(l.Vnode.Id, opts.Source) {
 				wg.Done()
-
-			}(l)
-
+				continue
+			}
+			go propose(l, txlog.Options{
+				Destination: l.Vnode.Id,
+				Source:      opts.Source,
+				PeerSetSize: opts.PeerSetSize,
+			})
 		}
 
 	} else {
 		// Broadcast to all vnodes
 		for _, l := range locs {
+			go propose(l, txlog.Options{
+				Destination: l.Vnode.Id,
+				Source:      l.Vnode.Id,
+				PeerSetSize: opts.PeerSetSize,
+			})
+		}
 
-			go func(loc *structs.Location) {
-
-				if atomic.LoadInt32(&bail) == 0 {
-					o := txlog.Options{
-						Destination: loc.Vnode.Id,
-						Source:      loc.Vnode.Id,
-						PeerSetSize: opts.PeerSetSize,
-					}
-					if _, er := lr.transport.ProposeTx(loc, tx, o); er != nil {
-						errCh <- er
-					}
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var (
+		acks    int
+		meta    *txlog.Meta
+		prepped = make([]*structs.Location, 0, needed)
+	)
+	for acks < needed {
+		select {
+		case a := <-ackCh:
+			acks++
+			meta = a.meta
+			prepped = append(prepped, a.loc)
+		case er := <-errCh:
+			merr.Add(er)
+		case <-done:
+			// All replicas have responded; fall through to drain remaining acks/errors.
+			for acks < needed {
+				select {
+				case a := <-ackCh:
+					acks++
+					meta = a.meta
+					prepped = append(prepped, a.loc)
+				case er := <-errCh:
+					merr.Add(er)
+				default:
+					// Quorum was never reached: the minority that did prepare would
+					// otherwise sit locked for RecoverPreparedTx's maxAge window, so
+					// abort them eagerly instead of handing the caller a prepped slice
+					// it has no safe way to commit.
+					lr.AbortCohort(ctx, prepped, tx, opts)
+					return nil, nil, merr.ErrorOrNil()
 				}
+			}
+		case <-ctx.Done():
+			lr.AbortCohort(context.Background(), prepped, tx, opts)
+			return nil, nil, ctx.Err()
+		}
+	}
 
-				wg.Done()
+	// Quorum reached: cancel the remaining in-flight ProposeTx calls via the deferred
+	// cancel() and return immediately rather than waiting on wg.
+	return meta, prepped, merr.ErrorOrNil()
+}
+
+// commitRetryAttempts bounds how many times CommitTx retries a single straggler replica
+// before giving up on it for this call.
+const commitRetryAttempts = 3
+
+// commitRetryBackoff is the delay between retries of a single straggler replica.
+const commitRetryBackoff = 200 * time.Millisecond
 
-			}(l)
+// CommitTx is the Commit phase of the two-phase commit protocol. preparedLocs must be
+// exactly the locations ProposeTx reported as having voted Prepare; CommitTx commits
+// only that set, retrying a replica that errors rather than aborting it, since once any
+// replica in preparedLocs has committed the transaction is final and a replica that
+// already committed must never be rolled back. Replicas that still fail after retrying
+// are left in StatePrepared for a later RecoverPreparedTx pass to settle.
+func (lr *LogRing) CommitTx(ctx context.Context, tx *txlog.Tx, preparedLocs []*structs.Location, opts txlog.Options) (*txlog.Meta, error) {
+	var (
+		meta      *txlog.Meta
+		committed []*structs.Location
+		merr      multiError
+	)
 
+	for _, loc := range preparedLocs {
+		o := opts
+		o.Destination = loc.Vnode.Id
+		if o.Source == nil || len(o.Source) == 0 {
+			o.Source = loc.Vnode.Id
 		}
 
+		m, er := lr.commitWithRetry(ctx, loc, tx, o)
+		if er != nil {
+			merr.Add(fmt.Errorf("commit to %x: %w", loc.Vnode.Id, er))
+			continue
+		}
+		meta = m
+		committed = append(committed, loc)
 	}
 
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
+	if len(committed) == 0 {
+		return nil, merr.ErrorOrNil()
+	}
 
-	select {
-	case <-done:
-	case err = <-errCh:
-		atomic.StoreInt32(&bail, 1)
+	// At least one replica committed, so the transaction is already final: the
+	// stragglers above are left in StatePrepared rather than aborted, for
+	// RecoverPreparedTx to push forward later. Their errors are still returned alongside
+	// meta so the partial failure surfaces to the caller.
+	return meta, merr.ErrorOrNil()
+}
+
+// commitWithRetry retries a single replica's CommitTx up to commitRetryAttempts times,
+// since a straggler that failed once may simply be transiently slow, not divergent.
+func (lr *LogRing) commitWithRetry(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error) {
+	var lastErr error
+	for attempt := 0; attempt < commitRetryAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(commitRetryBackoff):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		m, err := lr.transport.CommitTx(ctx, loc, tx, opts)
+		if err == nil {
+			return m, nil
+		}
+		lastErr = err
 	}
+	return nil, lastErr
+}
 
-	return meta, err
+// AbortCohort issues AbortTx to every replica in locs, logging nothing and returning
+// nothing: abort is best-effort cleanup, and a replica that never prepared tx simply
+// no-ops it. Callers must never include a replica that is known to have committed.
+// Exported so a caller holding the prepped slice ProposeTx returned on a quorum-failure
+// path (or any other prepared-but-uncommitted cohort) can release those locks
+// immediately instead of waiting for RecoverPreparedTx's maxAge timeout.
+func (lr *LogRing) AbortCohort(ctx context.Context, locs []*structs.Location, tx *txlog.Tx, opts txlog.Options) {
+	for _, loc := range locs {
+		opts.Destination = loc.Vnode.Id
+		lr.transport.AbortTx(ctx, loc, tx, opts)
+	}
 }
 
-func (lr *LogRing) CommitTx(tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error) {
+// RecoverPreparedTx re-queries the replica cohort for tx and drives it to a terminal
+// state if it has been stuck in StatePrepared for longer than maxAge. This closes the
+// window where a coordinator crash between Prepare and Commit would otherwise leave a
+// tx pending indefinitely: on restart, the recovering node calls this for any tx it
+// finds still in StatePrepared past maxAge. If any replica already committed, the
+// transaction is final and the remaining prepared replicas are pushed to commit, never
+// aborted; only when no replica has committed and too few prepared does it abort the
+// still-prepared set.
+func (lr *LogRing) RecoverPreparedTx(ctx context.Context, tx *txlog.Tx, opts txlog.Options, maxAge time.Duration) error {
 	locs, err := lr.locator.LocateReplicatedKey(tx.Key, int(opts.PeerSetSize))
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var meta *txlog.Meta
-	if opts.Source != nil && len(opts.Source) > 0 {
-		// Broadcast to all vnodes skipping the source.
-		for _, loc := range locs {
-			if utils.EqualBytes(loc.Vnode.Id, opts.Source) {
-				continue
-			}
+	var (
+		anyCommitted bool
+		preparedLocs []*structs.Location // prepared but not yet committed
+	)
+	for _, loc := range locs {
+		_, meta, er := lr.transport.GetTx(ctx, loc, tx.Hash, opts)
+		if er != nil {
+			continue
+		}
 
-			opts.Destination = loc.Vnode.Id
-			//log.Printf("action=commit src=%x dst=%s", opts.Source, utils.ShortVnodeID(loc.Vnode))
-			if _, er := lr.transport.CommitTx(loc, tx, opts); er != nil {
-				err = er
-				break
+		switch meta.State {
+		case txlog.StateCommitted:
+			anyCommitted = true
+		case txlog.StatePrepared:
+			if time.Since(meta.UpdatedAt) < maxAge {
+				// Still within the normal Prepare-to-Commit window; leave it alone.
+				return nil
 			}
+			preparedLocs = append(preparedLocs, loc)
 		}
+	}
 
-	} else {
-		// Broadcast to all vnodes
-		for _, loc := range locs {
-			opts.Source = loc.Vnode.Id
-			opts.Destination = loc.Vnode.Id
-			//log.Printf("action=commit src=%x dst=%s", opts.Source, utils.ShortVnodeID(loc.Vnode))
-			if _, er := lr.transport.CommitTx(loc, tx, opts); er != nil {
-				err = er
-				break
+	if anyCommitted || len(preparedLocs) >= ackThreshold(opts.WriteConsistency, len(locs), opts.N) {
+		_, err = lr.CommitTx(ctx, tx, preparedLocs, opts)
+		return err
+	}
+
+	lr.AbortCohort(ctx, preparedLocs, tx, opts)
+	return nil
+}
+
+// GetTx retrieves a transaction by hash. With the default ReadOne consistency it returns
+// the first successful response. At ReadQuorum/ReadAll it queries multiple replicas in
+// parallel and returns the one reporting the greatest txlog.Meta height, mirroring a
+// quorum read.
+func (lr *LogRing) GetTx(ctx context.Context, id []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+
+	if opts.ReadConsistency == ReadOne {
+		var (
+			tx   *txlog.Tx
+			meta *txlog.Meta
+		)
+
+		err := lr.locator.RouteHash(ctx, id, int(opts.PeerSetSize), func(l *structs.Location) bool {
+			t, m, err := lr.transport.GetTx(ctx, l, id, opts)
+			if err == nil {
+				tx = t
+				meta = m
+				return false
 			}
+			return true
+		})
+
+		if err == nil && tx == nil {
+			err = fmt.Errorf("tx not found")
 		}
 
+		return tx, meta, err
 	}
 
-	return meta, err
-}
+	_, vns, err := lr.locator.LookupHash(id, int(opts.PeerSetSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	n := len(vns)
+	if opts.ReadConsistency == ReadQuorum {
+		n = n/2 + 1
+	}
 
-func (lr *LogRing) GetTx(id []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	type result struct {
+		tx   *txlog.Tx
+		meta *txlog.Meta
+	}
+	resCh := make(chan result, len(vns))
+	for i, vn := range vns[:n] {
+		go func(loc *structs.Location) {
+			t, m, err := lr.transport.GetTx(ctx, loc, id, opts)
+			if err != nil {
+				resCh <- result{}
+				return
+			}
+			resCh <- result{tx: t, meta: m}
+		}(&structs.Location{Id: id, Vnode: vn, Priority: int32(i)})
+	}
 
 	var (
 		tx   *txlog.Tx
 		meta *txlog.Meta
 	)
-
-	err := lr.locator.RouteHash(id, int(opts.PeerSetSize), func(l *structs.Location) bool {
-		t, m, err := lr.transport.GetTx(l, id, opts)
-		if err == nil {
-			tx = t
-			meta = m
-			return false
+	for i := 0; i < n; i++ {
+		select {
+		case r := <-resCh:
+			if r.tx == nil {
+				continue
+			}
+			if meta == nil || r.meta.Height > meta.Height {
+				tx, meta = r.tx, r.meta
+			}
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
 		}
-		return true
-	})
+	}
 
-	if err == nil {
-		if tx == nil {
-			err = fmt.Errorf("tx not found")
-		}
+	if tx == nil {
+		return nil, nil, fmt.Errorf("tx not found")
 	}
+	return tx, meta, nil
+}
+
+// NewAntiEntropyLoop builds a background anti-entropy loop that reconciles ranges
+// registered via the returned Loop's AddRange against their replica peers, using
+// store for the local key range index and cfg to bound reconciliation concurrency and
+// bandwidth.
+func (lr *LogRing) NewAntiEntropyLoop(cfg antientropy.Config, store antientropy.RangeStore) *antientropy.Loop {
+	return antientropy.NewLoop(cfg, store)
+}
 
-	return tx, meta, err
+// AntiEntropyPeer wraps loc with this LogRing's transport for use as an
+// antientropy.Peer in a Range registered with NewAntiEntropyLoop.
+func (lr *LogRing) AntiEntropyPeer(loc *structs.Location) *antientropy.Peer {
+	return &antientropy.Peer{Location: loc, Log: lr.transport}
 }
 
 // EnableProximityShifting enables or disables proximity shifting.  Proximity shifing can only enabled
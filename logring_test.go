@@ -0,0 +1,198 @@
+package blockring
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexablock/blockring/antientropy"
+	"github.com/hexablock/blockring/structs"
+	"github.com/hexablock/txlog"
+)
+
+// fakeLogTransport is a LogTransport whose per-method behavior is driven by the maps a
+// test populates: propose/commit failures keyed by vnode id, and a counter of AbortTx
+// calls so tests can assert the eager-abort path fires exactly on the replicas that
+// prepared.
+type fakeLogTransport struct {
+	mu sync.Mutex
+
+	proposeFail map[string]bool
+	commitFail  map[string]int // number of times CommitTx should fail before succeeding
+
+	commitCalls int
+	abortCalls  []string
+}
+
+func newFakeLogTransport() *fakeLogTransport {
+	return &fakeLogTransport{
+		proposeFail: make(map[string]bool),
+		commitFail:  make(map[string]int),
+	}
+}
+
+func (f *fakeLogTransport) ProposeTx(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error) {
+	f.mu.Lock()
+	fail := f.proposeFail[string(loc.Vnode.Id)]
+	f.mu.Unlock()
+	if fail {
+		return nil, errors.New("propose failed")
+	}
+	return &txlog.Meta{State: txlog.StatePrepared}, nil
+}
+
+func (f *fakeLogTransport) NewTx(ctx context.Context, loc *structs.Location, key []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	return nil, nil, errors.New("not used in this test")
+}
+
+func (f *fakeLogTransport) GetTx(ctx context.Context, loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, error) {
+	return nil, nil, errors.New("not used in this test")
+}
+
+func (f *fakeLogTransport) CommitTx(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) (*txlog.Meta, error) {
+	f.mu.Lock()
+	id := string(loc.Vnode.Id)
+	f.commitCalls++
+	remaining := f.commitFail[id]
+	if remaining > 0 {
+		f.commitFail[id] = remaining - 1
+	}
+	f.mu.Unlock()
+
+	if remaining > 0 {
+		return nil, errors.New("commit failed")
+	}
+	return &txlog.Meta{State: txlog.StateCommitted}, nil
+}
+
+func (f *fakeLogTransport) AbortTx(ctx context.Context, loc *structs.Location, tx *txlog.Tx, opts txlog.Options) error {
+	f.mu.Lock()
+	f.abortCalls = append(f.abortCalls, string(loc.Vnode.Id))
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *fakeLogTransport) GetTxWithProof(ctx context.Context, loc *structs.Location, hash []byte, opts txlog.Options) (*txlog.Tx, *txlog.Meta, *MerkleProof, error) {
+	return nil, nil, nil, errors.New("not used in this test")
+}
+
+func (f *fakeLogTransport) RangeDigest(ctx context.Context, loc *structs.Location, rangeStart, rangeEnd []byte, depth int, path []byte) (*antientropy.Digest, error) {
+	return nil, errors.New("not used in this test")
+}
+
+func (f *fakeLogTransport) abortedFor(id byte) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, a := range f.abortCalls {
+		if a == string([]byte{id}) {
+			n++
+		}
+	}
+	return n
+}
+
+func locWithID(id byte) *structs.Location {
+	return &structs.Location{Vnode: &structs.Vnode{Id: []byte{id}}}
+}
+
+func TestProposeCohortReachesQuorum(t *testing.T) {
+	trans := newFakeLogTransport()
+	lr := &LogRing{transport: trans}
+
+	locs := []*structs.Location{locWithID('A'), locWithID('B'), locWithID('C')}
+	tx := &txlog.Tx{Key: []byte("k1")}
+	opts := txlog.Options{PeerSetSize: 3, WriteConsistency: WriteQuorum}
+
+	_, prepped, err := lr.proposeCohort(context.Background(), locs, tx, opts)
+	if err != nil {
+		t.Fatalf("proposeCohort returned an error: %v", err)
+	}
+	if len(prepped) < 2 {
+		t.Fatalf("expected quorum (2 of 3) replicas prepared, got %d", len(prepped))
+	}
+}
+
+func TestProposeCohortAbortsPreppedOnQuorumFailure(t *testing.T) {
+	trans := newFakeLogTransport()
+	trans.proposeFail[string([]byte{'B'})] = true
+	trans.proposeFail[string([]byte{'C'})] = true
+	lr := &LogRing{transport: trans}
+
+	locs := []*structs.Location{locWithID('A'), locWithID('B'), locWithID('C')}
+	tx := &txlog.Tx{Key: []byte("k1")}
+	// WriteAll can never be satisfied since B and C always fail to prepare.
+	opts := txlog.Options{PeerSetSize: 3, WriteConsistency: WriteAll}
+
+	meta, prepped, err := lr.proposeCohort(context.Background(), locs, tx, opts)
+	if err == nil {
+		t.Fatal("expected an error when quorum cannot be reached")
+	}
+	if meta != nil || prepped != nil {
+		t.Fatalf("expected no usable prepared slice after a quorum failure, got meta=%v prepped=%v", meta, prepped)
+	}
+
+	if trans.abortedFor('A') == 0 {
+		t.Fatal("expected the replica that did prepare (A) to be aborted eagerly")
+	}
+}
+
+func TestCommitTxRetriesThenSucceeds(t *testing.T) {
+	trans := newFakeLogTransport()
+	trans.commitFail[string([]byte{'A'})] = 2 // fails twice, succeeds on the 3rd attempt
+	lr := &LogRing{transport: trans}
+
+	locs := []*structs.Location{locWithID('A')}
+	tx := &txlog.Tx{Key: []byte("k1")}
+
+	// Time the call to confirm CommitTx waits commitRetryBackoff between retries.
+	start := time.Now()
+	meta, err := lr.CommitTx(context.Background(), tx, locs, txlog.Options{})
+	if err != nil {
+		t.Fatalf("CommitTx returned an error: %v", err)
+	}
+	if meta == nil || meta.State != txlog.StateCommitted {
+		t.Fatalf("expected a committed meta, got %v", meta)
+	}
+	if trans.commitCalls != 3 {
+		t.Fatalf("expected 3 CommitTx attempts (2 failures + 1 success), got %d", trans.commitCalls)
+	}
+	if time.Since(start) < 2*commitRetryBackoff {
+		t.Fatal("expected CommitTx to wait commitRetryBackoff between retries")
+	}
+}
+
+func TestCommitTxNeverAbortsAnAlreadyCommittedReplica(t *testing.T) {
+	trans := newFakeLogTransport()
+	// A commits on the first try; B fails every attempt.
+	trans.commitFail[string([]byte{'B'})] = commitRetryAttempts
+
+	lr := &LogRing{transport: trans}
+	locs := []*structs.Location{locWithID('A'), locWithID('B')}
+	tx := &txlog.Tx{Key: []byte("k1")}
+
+	meta, err := lr.CommitTx(context.Background(), tx, locs, txlog.Options{})
+	if err == nil {
+		t.Fatal("expected CommitTx to surface B's persistent failure")
+	}
+	if meta == nil || meta.State != txlog.StateCommitted {
+		t.Fatalf("expected A's commit to still be reported as the result, got %v", meta)
+	}
+	if len(trans.abortCalls) != 0 {
+		t.Fatalf("a replica that committed (or a straggler left for recovery) must never be aborted by CommitTx, got aborts=%v", trans.abortCalls)
+	}
+}
+
+func TestAbortCohortAbortsEveryLocation(t *testing.T) {
+	trans := newFakeLogTransport()
+	lr := &LogRing{transport: trans}
+
+	locs := []*structs.Location{locWithID('A'), locWithID('B')}
+	lr.AbortCohort(context.Background(), locs, &txlog.Tx{Key: []byte("k1")}, txlog.Options{})
+
+	if trans.abortedFor('A') != 1 || trans.abortedFor('B') != 1 {
+		t.Fatalf("expected exactly one AbortTx per location, got calls=%v", trans.abortCalls)
+	}
+}
@@ -0,0 +1,297 @@
+// Package sync implements fast-sync for a vnode that has rejoined the ring and needs to
+// bulk-reconcile a key range against its replica peers instead of fetching key-by-key.
+// It follows the skeleton-based approach used by the Bytom and go-ethereum downloaders:
+// a sparse skeleton of headers is fetched from a single peer first, the gaps between
+// skeleton anchors are then filled concurrently from the whole peer set, and bodies are
+// fetched in a second pipeline once a filled chunk has been verified against its anchor.
+package sync
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hexablock/blockring/structs"
+)
+
+// defaultSkeletonStep is the number of log entries between skeleton anchors when the
+// caller does not specify one.
+const defaultSkeletonStep = 192
+
+// peerInFlightLimit caps the number of outstanding fill requests issued to a single peer
+// at once, so a single slow peer cannot monopolize the work queue.
+const peerInFlightLimit = 4
+
+// fillTimeout bounds how long a peer is given to answer a fill request before the chunk
+// is reassigned to another peer and the slow peer is dropped from the round.
+const fillTimeout = 10 * time.Second
+
+// LogTransport is the subset of LogTransport a Syncer needs to fetch a header skeleton
+// and fill in the headers between skeleton anchors.
+type LogTransport interface {
+	GetHeaderSkeleton(ctx context.Context, loc *structs.Location, keyRange structs.KeyRange, step int) ([]*structs.LogEntryBlock, error)
+	// GetHeaderRange returns the headers for every key strictly between start and end,
+	// i.e. the open interval (start, end) excluding the skeleton anchors themselves; end
+	// may be nil to mean through the end of the owning range. A Syncer calls this once
+	// per skeleton gap to fill in the keys the sparse skeleton skipped over.
+	GetHeaderRange(ctx context.Context, loc *structs.Location, start, end []byte) ([]*structs.LogEntryBlock, error)
+	GetLogBlock(ctx context.Context, loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogBlock, *structs.Location, error)
+}
+
+// BlockTransport is the subset of BlockTransport a Syncer needs to persist fetched
+// bodies locally once their headers have been verified.
+type BlockTransport interface {
+	SetBlock(ctx context.Context, loc *structs.Location, block *structs.Block) error
+}
+
+// Peer is a replica a Syncer can ask for a skeleton, a fill chunk, or a body during a
+// sync round.
+type Peer struct {
+	Location *structs.Location
+	Log      LogTransport
+	Block    BlockTransport
+}
+
+// ProgressFunc reports fast-sync progress: done out of total skeleton gaps filled in so far.
+type ProgressFunc func(done, total int)
+
+// Syncer fast-syncs a key range from a set of replica peers.
+type Syncer struct {
+	step     int
+	progress ProgressFunc
+
+	mu       sync.Mutex
+	excluded map[string]bool // peers dropped from the current sync round
+}
+
+// New instantiates a Syncer that reports progress via the given callback, which may be
+// nil. The skeleton step defaults to one header every 192 entries.
+func New(progress ProgressFunc) *Syncer {
+	return &Syncer{
+		step:     defaultSkeletonStep,
+		progress: progress,
+		excluded: make(map[string]bool),
+	}
+}
+
+// WithStep overrides the default skeleton step.
+func (s *Syncer) WithStep(step int) *Syncer {
+	if step > 0 {
+		s.step = step
+	}
+	return s
+}
+
+// Sync fast-syncs keyRange from peers: it fetches a header skeleton from the first peer
+// that owns the range, fills the gaps between skeleton anchors concurrently across the
+// peer set (the skeleton peer included), and fetches bodies for the filled headers via a second pipeline that
+// writes them to the local block store. A peer that returns a chunk failing to link to
+// its skeleton anchor, or that exceeds fillTimeout, is dropped from the round.
+func (s *Syncer) Sync(ctx context.Context, keyRange structs.KeyRange, peers []*Peer) error {
+	if len(peers) == 0 {
+		return fmt.Errorf("sync: no peers supplied")
+	}
+
+	anchorPeer := peers[0]
+	skeleton, err := anchorPeer.Log.GetHeaderSkeleton(ctx, anchorPeer.Location, keyRange, s.step)
+	if err != nil {
+		return fmt.Errorf("sync: skeleton fetch from %x failed: %w", anchorPeer.Location.Vnode.Id, err)
+	}
+	if len(skeleton) == 0 {
+		return nil
+	}
+
+	headers, err := s.fillGaps(ctx, skeleton, keyRange, peers)
+	if err != nil {
+		return err
+	}
+
+	return s.fetchBodies(ctx, headers, peers)
+}
+
+// fillGaps fetches the headers between each pair of skeleton anchors from the peer set,
+// one goroutine per gap, each trying peers in order and reassigning to the next peer
+// when the current one stalls, errors, or returns a chunk that does not chain to its
+// anchor. A gap spans from its anchor's key up to the next anchor's key, or keyRange's
+// end for the final anchor. A per-peer semaphore caps how many gaps are fetched from the
+// same peer at once, since a gap's goroutine is independent of every other gap's.
+func (s *Syncer) fillGaps(ctx context.Context, skeleton []*structs.LogEntryBlock, keyRange structs.KeyRange, peers []*Peer) ([]*structs.LogEntryBlock, error) {
+	sems := make(map[string]chan struct{}, len(peers))
+	for _, p := range peers {
+		sems[peerKey(p)] = make(chan struct{}, peerInFlightLimit)
+	}
+
+	var (
+		mu      sync.Mutex
+		results = make([]*structs.LogEntryBlock, 0, len(skeleton))
+		filledN int // gaps filled so far, reported to progress out of len(skeleton)
+		wg      sync.WaitGroup
+	)
+
+	wg.Add(len(skeleton))
+	for i, anchor := range skeleton {
+		anchor := anchor
+
+		end := keyRange.End
+		if i+1 < len(skeleton) {
+			end = skeleton[i+1].Key
+		}
+
+		go func(end []byte) {
+			defer wg.Done()
+
+			filled, ok := s.fillAnchor(ctx, anchor, end, peers, sems)
+			if !ok {
+				return
+			}
+
+			mu.Lock()
+			results = append(results, filled...)
+			filledN++
+			done := filledN
+			mu.Unlock()
+
+			if s.progress != nil {
+				s.progress(done, len(skeleton))
+			}
+		}(end)
+	}
+	wg.Wait()
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("sync: no peers were able to fill the skeleton")
+	}
+	return results, nil
+}
+
+// fillAnchor tries each peer in order, skipping any already excluded from the round,
+// until one successfully fills and links the headers strictly between anchor.Key and end
+// back to anchor. A peer that errors, times out, or returns a chunk that does not chain to
+// anchor is excluded and the gap is reassigned to the next peer in the list.
+func (s *Syncer) fillAnchor(ctx context.Context, anchor *structs.LogEntryBlock, end []byte, peers []*Peer, sems map[string]chan struct{}) ([]*structs.LogEntryBlock, bool) {
+	for _, p := range peers {
+		if ctx.Err() != nil {
+			return nil, false
+		}
+		if s.isExcluded(p) {
+			continue
+		}
+
+		sem := sems[peerKey(p)]
+		sem <- struct{}{}
+		filled, err := s.fetchWithTimeout(ctx, p, anchor, end)
+		<-sem
+
+		if err != nil {
+			s.exclude(p)
+			continue
+		}
+		if !linksToAnchor(filled, anchor) {
+			s.exclude(p)
+			continue
+		}
+
+		return filled, true
+	}
+	return nil, false
+}
+
+// fetchWithTimeout fetches the headers strictly between anchor.Key and end from peer p,
+// bounding the wait by fillTimeout so a stalled peer can be reassigned promptly.
+func (s *Syncer) fetchWithTimeout(ctx context.Context, p *Peer, anchor *structs.LogEntryBlock, end []byte) ([]*structs.LogEntryBlock, error) {
+	type fillResult struct {
+		headers []*structs.LogEntryBlock
+		err     error
+	}
+
+	resCh := make(chan fillResult, 1)
+	go func() {
+		headers, err := p.Log.GetHeaderRange(ctx, p.Location, anchor.Key, end)
+		if err != nil {
+			resCh <- fillResult{err: err}
+			return
+		}
+		resCh <- fillResult{headers: headers}
+	}()
+
+	select {
+	case r := <-resCh:
+		return r.headers, r.err
+	case <-time.After(fillTimeout):
+		return nil, fmt.Errorf("sync: peer %x timed out filling chunk", p.Location.Vnode.Id)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// linksToAnchor reports whether the first header in a filled chunk chains back to the
+// skeleton anchor it was requested against.
+func linksToAnchor(filled []*structs.LogEntryBlock, anchor *structs.LogEntryBlock) bool {
+	if len(filled) == 0 {
+		return false
+	}
+	return string(filled[0].PrevHash) == string(anchor.ID())
+}
+
+// fetchBodies fetches and persists the block body for each header, spreading the
+// requests across the peer set.
+func (s *Syncer) fetchBodies(ctx context.Context, headers []*structs.LogEntryBlock, peers []*Peer) error {
+	sem := make(chan struct{}, peerInFlightLimit*len(peers))
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+
+	for i, h := range headers {
+		h := h
+		peer := peers[i%len(peers)]
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			blk, _, err := peer.Log.GetLogBlock(ctx, peer.Location, h.Key, structs.DefaultRequestOptions())
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			for _, b := range blk.Blocks() {
+				if err := peer.Block.SetBlock(ctx, peer.Location, b); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return fmt.Errorf("sync: %d bodies failed to fetch", len(errs))
+	}
+	return nil
+}
+
+func (s *Syncer) exclude(p *Peer) {
+	s.mu.Lock()
+	s.excluded[peerKey(p)] = true
+	s.mu.Unlock()
+}
+
+func (s *Syncer) isExcluded(p *Peer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.excluded[peerKey(p)]
+}
+
+// peerKey identifies a peer by its vnode id, for use as a map key in per-round
+// bookkeeping (exclusion, per-peer semaphores).
+func peerKey(p *Peer) string {
+	return string(p.Location.Vnode.Id)
+}
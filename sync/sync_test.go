@@ -0,0 +1,208 @@
+package sync
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/hexablock/blockring/structs"
+)
+
+// fakeLogTransport always stamps filled entries with prevHash, so they chain to
+// whichever anchor the test constructs, and errors for every peer id in fail.
+type fakeLogTransport struct {
+	mu        sync.Mutex
+	fillCalls map[string]int
+	rangeArgs []rangeArgs
+	fail      map[string]bool
+	prevHash  []byte
+	// linkFor, when set, overrides prevHash per start key so a transport serving
+	// several distinct gaps in one test can link each to its own anchor.
+	linkFor map[string][]byte
+}
+
+// rangeArgs records the (start, end) a GetHeaderRange call was made with, so tests can
+// assert a gap's boundaries were threaded to the next anchor (or keyRange.End) rather
+// than re-fetching the anchor's own key.
+type rangeArgs struct {
+	start, end []byte
+}
+
+func newFakeLogTransport(prevHash []byte, failing ...byte) *fakeLogTransport {
+	fail := make(map[string]bool, len(failing))
+	for _, id := range failing {
+		fail[string([]byte{id})] = true
+	}
+	return &fakeLogTransport{fillCalls: make(map[string]int), fail: fail, prevHash: prevHash}
+}
+
+func (f *fakeLogTransport) GetHeaderSkeleton(ctx context.Context, loc *structs.Location, keyRange structs.KeyRange, step int) ([]*structs.LogEntryBlock, error) {
+	return nil, errors.New("not used in this test")
+}
+
+func (f *fakeLogTransport) GetHeaderRange(ctx context.Context, loc *structs.Location, start, end []byte) ([]*structs.LogEntryBlock, error) {
+	id := string(loc.Vnode.Id)
+
+	f.mu.Lock()
+	f.fillCalls[id]++
+	f.rangeArgs = append(f.rangeArgs, rangeArgs{start: start, end: end})
+	fail := f.fail[id]
+	f.mu.Unlock()
+
+	if fail {
+		return nil, errors.New("peer unavailable")
+	}
+
+	prevHash := f.prevHash
+	if f.linkFor != nil {
+		prevHash = f.linkFor[string(start)]
+	}
+	return []*structs.LogEntryBlock{{Key: start, PrevHash: prevHash}}, nil
+}
+
+func (f *fakeLogTransport) GetLogBlock(ctx context.Context, loc *structs.Location, key []byte, opts structs.RequestOptions) (*structs.LogBlock, *structs.Location, error) {
+	return structs.NewLogBlock(&structs.LogEntryBlock{Key: key, PrevHash: f.prevHash}), loc, nil
+}
+
+func (f *fakeLogTransport) callsFor(id byte) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fillCalls[string([]byte{id})]
+}
+
+type fakeBlockTransport struct{}
+
+func (f *fakeBlockTransport) SetBlock(ctx context.Context, loc *structs.Location, block *structs.Block) error {
+	return nil
+}
+
+func peerWithID(id byte, log LogTransport) *Peer {
+	return &Peer{
+		Location: &structs.Location{Vnode: &structs.Vnode{Id: []byte{id}}},
+		Log:      log,
+		Block:    &fakeBlockTransport{},
+	}
+}
+
+func TestFillGapsReassignsToNextPeerOnError(t *testing.T) {
+	anchor := &structs.LogEntryBlock{Key: []byte("k1")}
+	skeleton := []*structs.LogEntryBlock{anchor}
+
+	trans := newFakeLogTransport(anchor.ID(), 'A')
+	peers := []*Peer{
+		peerWithID('A', trans), // always errors, must be excluded and not block the anchor
+		peerWithID('B', trans), // must pick up the anchor peer A dropped
+	}
+
+	s := New(nil)
+	headers, err := s.fillGaps(context.Background(), skeleton, structs.KeyRange{}, peers)
+	if err != nil {
+		t.Fatalf("fillGaps returned an error: %v", err)
+	}
+	if len(headers) != 1 {
+		t.Fatalf("expected 1 header filled, got %d", len(headers))
+	}
+
+	if !s.isExcluded(peers[0]) {
+		t.Fatal("peer A should have been excluded after erroring")
+	}
+	if s.isExcluded(peers[1]) {
+		t.Fatal("peer B should not have been excluded")
+	}
+	if trans.callsFor('B') == 0 {
+		t.Fatal("expected peer B to have been asked to fill the anchor peer A dropped")
+	}
+}
+
+func TestFillGapsFailsWhenEveryPeerErrors(t *testing.T) {
+	anchor := &structs.LogEntryBlock{Key: []byte("k1")}
+	skeleton := []*structs.LogEntryBlock{anchor}
+
+	trans := newFakeLogTransport(anchor.ID(), 'A', 'B')
+	peers := []*Peer{peerWithID('A', trans), peerWithID('B', trans)}
+
+	s := New(nil)
+	if _, err := s.fillGaps(context.Background(), skeleton, structs.KeyRange{}, peers); err == nil {
+		t.Fatal("expected an error when every peer fails to fill the skeleton")
+	}
+}
+
+func TestFillGapsUsesNextAnchorAsGapEnd(t *testing.T) {
+	anchor1 := &structs.LogEntryBlock{Key: []byte("k1")}
+	anchor2 := &structs.LogEntryBlock{Key: []byte("k2")}
+	skeleton := []*structs.LogEntryBlock{anchor1, anchor2}
+
+	trans := newFakeLogTransport(nil)
+	trans.linkFor = map[string][]byte{
+		"k1": anchor1.ID(),
+		"k2": anchor2.ID(),
+	}
+	peers := []*Peer{peerWithID('A', trans)}
+
+	s := New(nil)
+	if _, err := s.fillGaps(context.Background(), skeleton, structs.KeyRange{End: []byte("zzz")}, peers); err != nil {
+		t.Fatalf("fillGaps returned an error: %v", err)
+	}
+
+	if len(trans.rangeArgs) != 2 {
+		t.Fatalf("expected one GetHeaderRange call per anchor, got %d", len(trans.rangeArgs))
+	}
+
+	var gotK1, gotK2 bool
+	for _, a := range trans.rangeArgs {
+		switch string(a.start) {
+		case "k1":
+			gotK1 = true
+			if string(a.end) != "k2" {
+				t.Fatalf("expected k1's gap to end at the next anchor's key k2, got %q", a.end)
+			}
+		case "k2":
+			gotK2 = true
+			if string(a.end) != "zzz" {
+				t.Fatalf("expected the last anchor's gap to end at keyRange.End, got %q", a.end)
+			}
+		}
+	}
+	if !gotK1 || !gotK2 {
+		t.Fatalf("expected GetHeaderRange calls for both anchors, got %+v", trans.rangeArgs)
+	}
+}
+
+func TestSyncNoPeers(t *testing.T) {
+	s := New(nil)
+	if err := s.Sync(context.Background(), structs.KeyRange{}, nil); err == nil {
+		t.Fatal("expected an error when no peers are supplied")
+	}
+}
+
+func TestLinksToAnchor(t *testing.T) {
+	anchor := &structs.LogEntryBlock{Key: []byte("k1")}
+
+	if linksToAnchor(nil, anchor) {
+		t.Fatal("an empty filled chunk must not link to the anchor")
+	}
+
+	linked := []*structs.LogEntryBlock{{PrevHash: anchor.ID()}}
+	if !linksToAnchor(linked, anchor) {
+		t.Fatal("a chunk whose first header's PrevHash matches the anchor's ID should link")
+	}
+
+	unlinked := []*structs.LogEntryBlock{{PrevHash: []byte("not-the-anchor")}}
+	if linksToAnchor(unlinked, anchor) {
+		t.Fatal("a chunk whose first header does not chain to the anchor should not link")
+	}
+}
+
+func TestExcludeIsolatesPeerAcrossCalls(t *testing.T) {
+	s := New(nil)
+	p := peerWithID('Z', nil)
+
+	if s.isExcluded(p) {
+		t.Fatal("a peer should not start excluded")
+	}
+	s.exclude(p)
+	if !s.isExcluded(p) {
+		t.Fatal("exclude should mark the peer as excluded")
+	}
+}